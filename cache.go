@@ -1,14 +1,25 @@
 package webcache
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
 type cache struct {
 	store sync.Map
+	clock Clock
+}
+
+type cacheEntry struct {
+	value   []byte
+	expires time.Time
 }
 
 type Cache[K comparable, V any] interface {
@@ -17,8 +28,41 @@ type Cache[K comparable, V any] interface {
 	Delete(key K)
 }
 
+// ExpiringCache is a Cache that can expire entries on its own.
+type ExpiringCache[K comparable, V any] interface {
+	Cache[K, V]
+	// SetWithTTL stores the value and expires it once ttl has elapsed.
+	// A ttl of zero or less means the entry does not expire.
+	SetWithTTL(key K, value V, ttl time.Duration)
+}
+
+// StreamingCache is a cache whose values are written and read as streams, so that large values are
+// never held in memory. The metadata of an entry is stored apart from its value, and the entry is
+// only visible once its value is completely written and committed.
+// The methods are named apart from those of Cache, so that a cache can implement both and share
+// its keys between them.
+type StreamingCache interface {
+	// PutStream starts writing the entry for the key with its metadata. The entry replaces the one stored
+	// for the key once the returned writer is committed, and is discarded if the writer is aborted.
+	PutStream(key string, metadata []byte) (EntryWriter, error)
+	// GetStream returns the metadata of the entry for the key, and a reader of its value that the caller closes.
+	GetStream(key string) ([]byte, io.ReadCloser, bool)
+	// UpdateMetadata replaces the metadata of the entry for the key, its value is left as is.
+	UpdateMetadata(key string, metadata []byte) error
+	Delete(key string)
+}
+
+// EntryWriter writes the value of an entry of a StreamingCache.
+type EntryWriter interface {
+	io.Writer
+	// Commit stores the entry, it can no longer be written.
+	Commit() error
+	// Abort discards the entry, the entry stored for the key is left as is.
+	Abort() error
+}
+
 func NewCache() Cache[string, []byte] {
-	return &cache{}
+	return &cache{clock: NewClock()}
 }
 
 func (c *cache) Get(key string) ([]byte, bool) {
@@ -26,17 +70,39 @@ func (c *cache) Get(key string) ([]byte, bool) {
 	if !ok {
 		return nil, false
 	}
-	return v.([]byte), true
+	entry := v.(*cacheEntry)
+	if expired(entry.expires, c.clock) {
+		c.store.CompareAndDelete(key, v)
+		return nil, false
+	}
+	return entry.value, true
 }
 
 func (c *cache) Set(key string, value []byte) {
-	c.store.Store(key, value)
+	c.store.Store(key, &cacheEntry{value: value})
+}
+
+func (c *cache) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	c.store.Store(key, &cacheEntry{value: value, expires: expiresAfter(ttl, c.clock)})
 }
 
 func (c *cache) Delete(key string) {
 	c.store.Delete(key)
 }
 
+// expiresAfter returns the expiry time of an entry stored now with the ttl,
+// or the zero time when the entry does not expire.
+func expiresAfter(ttl time.Duration, clock Clock) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return clock.Now().Add(ttl)
+}
+
+func expired(expires time.Time, clock Clock) bool {
+	return !expires.IsZero() && !clock.Now().Before(expires)
+}
+
 type cacheKey string
 
 func (k cacheKey) String() string {
@@ -46,25 +112,38 @@ func (k cacheKey) String() string {
 // cacheKey returns a cache key for the request.
 // The cache key is a string that uniquely identifies the request.
 // The cache key is used to store and retrieve the response from the cache.
-// The cache key is generated from the request method, the request URL and the Vary header.
+// The cache key is generated from the request method and the request URL,
+// responses that vary on request headers are stored under variant keys, see buildVariantKey.
 func buildCacheKey(r *http.Request) cacheKey {
 	components := make([]string, 0)
 	components = append(components, r.Method)
 	components = append(components, r.URL.String())
-	components = append(components, componentsFromVaryHeader(r.Header)...)
 
 	return cacheKey(fmt.Sprintf("cache_key=%s", strings.Join(components, "_")))
 }
 
-func componentsFromVaryHeader(h http.Header) []string {
-	components := make([]string, 0)
-	vary := h.Get("Vary")
-	varyHeaderKeys := strings.Split(vary, ",")
-	for i := range varyHeaderKeys {
-		v := h.Get(strings.TrimSpace(varyHeaderKeys[i]))
-		if v != "" {
-			components = append(components, v)
+// buildVariantKey returns the cache key of a response stored under the primary key,
+// selected by the values of the request fields listed in the Vary header of the response.
+// The fields are hashed with their lengths and whether they are present, so that different
+// field values, or an empty field and a missing one, never share a key.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.1
+func buildVariantKey(primary cacheKey, vary []string, values map[string]string) cacheKey {
+	h := sha256.New()
+	writeField := func(s string) {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(s)))
+		h.Write(n[:])
+		h.Write([]byte(s))
+	}
+	for _, name := range vary {
+		writeField(strings.ToLower(name))
+		value, ok := values[name]
+		if !ok {
+			h.Write([]byte{0})
+			continue
 		}
+		h.Write([]byte{1})
+		writeField(value)
 	}
-	return components
+	return cacheKey(fmt.Sprintf("%s_variant=%s", primary, hex.EncodeToString(h.Sum(nil))))
 }
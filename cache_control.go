@@ -0,0 +1,226 @@
+package webcache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrorInvalidCacheControl   = errors.New("invalid cache-control")
+	ErrorDuplicateDirective    = errors.New("duplicate cache-control directive")
+	ErrorConflictingDirectives = errors.New("conflicting cache-control directives")
+)
+
+// conflictingDirectives are pairs of directives that cannot apply to the same message.
+var conflictingDirectives = [][2]cacheControlKey{
+	{cacheControlKeyPublic, cacheControlKeyPrivate},
+}
+
+// fieldListDirectives are the directives whose argument is a list of field names, always sent as a quoted-string.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.4
+var fieldListDirectives = map[cacheControlKey]bool{
+	cacheControlKeyNoCache: true,
+	cacheControlKeyPrivate: true,
+}
+
+// ParseCacheControl parses the Cache-Control field lines of the header.
+// Directive names are case-insensitive and are lowercased, arguments are either tokens or quoted-strings.
+// When a directive is repeated, whatever the case of its name and its arguments, its first occurrence is kept
+// and ErrorDuplicateDirective is returned. The directives parsed so far are returned along with any error.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2
+func ParseCacheControl(h http.Header) (CacheControl, error) {
+	cc := CacheControl{}
+	var errs []error
+	for _, line := range h.Values("Cache-Control") {
+		if err := cc.parse(line); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, pair := range conflictingDirectives {
+		_, a := cc[pair[0]]
+		_, b := cc[pair[1]]
+		if a && b {
+			errs = append(errs, fmt.Errorf("%w: %s and %s", ErrorConflictingDirectives, pair[0], pair[1]))
+		}
+	}
+	return cc, errors.Join(errs...)
+}
+
+// parse adds the directives of a field line, a comma-separated list of directives.
+// https://www.rfc-editor.org/rfc/rfc9110#section-5.6.1
+func (c CacheControl) parse(s string) error {
+	var errs []error
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return errors.Join(errs...)
+		}
+
+		name, rest := cutToken(s)
+		if name == "" {
+			errs = append(errs, fmt.Errorf("%w: unexpected %q", ErrorInvalidCacheControl, s))
+			s = skipListMember(s)
+			continue
+		}
+
+		value := ""
+		rest = strings.TrimLeft(rest, " \t")
+		if strings.HasPrefix(rest, "=") {
+			rest = strings.TrimLeft(rest[1:], " \t")
+			var err error
+			if strings.HasPrefix(rest, `"`) {
+				value, rest, err = cutQuotedString(rest)
+			} else {
+				value, rest = cutToken(rest)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%w: %s: %w", ErrorInvalidCacheControl, name, err))
+				return errors.Join(errs...)
+			}
+		}
+
+		rest = strings.TrimLeft(rest, " \t")
+		if rest != "" && rest[0] != ',' {
+			errs = append(errs, fmt.Errorf("%w: unexpected %q after %s", ErrorInvalidCacheControl, rest, name))
+			rest = skipListMember(rest)
+		}
+		s = rest
+
+		key := cacheControlKey(strings.ToLower(name))
+		if _, ok := c[key]; ok {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrorDuplicateDirective, key))
+			continue
+		}
+		c[key] = value
+	}
+}
+
+// String serializes the directives, sorted by name, as the value of a Cache-Control header.
+// It is parsed back into the same directives.
+func (c CacheControl) String() string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+
+	directives := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := c[cacheControlKey(k)]
+		switch {
+		case v == "":
+			// an unqualified no-cache or private applies to the whole response, it is written without argument
+			directives = append(directives, k)
+		case isToken(v) && !fieldListDirectives[cacheControlKey(k)]:
+			directives = append(directives, k+"="+v)
+		default:
+			directives = append(directives, k+"="+quoteString(v))
+		}
+	}
+	return strings.Join(directives, ", ")
+}
+
+// Set sets the directive, an empty value sets a directive without argument.
+func (c CacheControl) Set(directive, value string) {
+	c[cacheControlKey(strings.ToLower(directive))] = value
+}
+
+// Del removes the directive.
+func (c CacheControl) Del(directive string) {
+	delete(c, cacheControlKey(strings.ToLower(directive)))
+}
+
+// NoCacheFields returns the field names listed by a qualified no-cache directive.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.4
+func (c CacheControl) NoCacheFields() []string {
+	return fieldNames(c[cacheControlKeyNoCache])
+}
+
+// PrivateFields returns the field names listed by a qualified private directive.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.7
+func (c CacheControl) PrivateFields() []string {
+	return fieldNames(c[cacheControlKeyPrivate])
+}
+
+// fieldNames returns the canonical field names of a comma-separated list.
+func fieldNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// isTokenChar reports whether c is a tchar.
+// https://www.rfc-editor.org/rfc/rfc9110#section-5.6.2
+func isTokenChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// cutToken returns the token at the start of s and the rest of s.
+func cutToken(s string) (string, string) {
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// cutQuotedString returns the unescaped content of the quoted-string at the start of s and the rest of s.
+// https://www.rfc-editor.org/rfc/rfc9110#section-5.6.4
+func cutQuotedString(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+1 == len(s) {
+				return "", "", errors.New("unterminated quoted-string")
+			}
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return "", "", errors.New("unterminated quoted-string")
+}
+
+func quoteString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// skipListMember returns s after the next comma outside of a quoted-string.
+func skipListMember(s string) string {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ',' && !quoted:
+			return s[i:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+package webcache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		cc    CacheControl
+		err   error
+	}{
+		{
+			name:  "tokens",
+			lines: []string{"max-age=60, must-revalidate"},
+			cc:    CacheControl{"max-age": "60", "must-revalidate": ""},
+		},
+		{
+			name:  "uppercase names",
+			lines: []string{"Max-Age=60, NO-STORE"},
+			cc:    CacheControl{"max-age": "60", "no-store": ""},
+		},
+		{
+			name:  "quoted field lists",
+			lines: []string{`no-cache="Set-Cookie, X-Foo", private="Authorization"`},
+			cc:    CacheControl{"no-cache": "Set-Cookie, X-Foo", "private": "Authorization"},
+		},
+		{
+			name:  "escaped quotes",
+			lines: []string{`ext="a \"b\" c", max-age="30"`},
+			cc:    CacheControl{"ext": `a "b" c`, "max-age": "30"},
+		},
+		{
+			name:  "several field lines and empty members",
+			lines: []string{"max-age=60,, ", " public"},
+			cc:    CacheControl{"max-age": "60", "public": ""},
+		},
+		{
+			name:  "duplicate",
+			lines: []string{"max-age=60", "max-age=120"},
+			cc:    CacheControl{"max-age": "60"},
+			err:   ErrorDuplicateDirective,
+		},
+		{
+			name:  "repeated",
+			lines: []string{"max-age=60, max-age=60"},
+			cc:    CacheControl{"max-age": "60"},
+			err:   ErrorDuplicateDirective,
+		},
+		{
+			name:  "repeated in another case",
+			lines: []string{"MAX-AGE=60", "max-age=60"},
+			cc:    CacheControl{"max-age": "60"},
+			err:   ErrorDuplicateDirective,
+		},
+		{
+			name:  "conflicting",
+			lines: []string{"public, private"},
+			cc:    CacheControl{"public": "", "private": ""},
+			err:   ErrorConflictingDirectives,
+		},
+		{
+			name:  "invalid member",
+			lines: []string{`max-age=60 60, "x", no-store`},
+			cc:    CacheControl{"max-age": "60", "no-store": ""},
+			err:   ErrorInvalidCacheControl,
+		},
+		{
+			name:  "unterminated quoted-string",
+			lines: []string{`no-cache="Set-Cookie, max-age=60`},
+			cc:    CacheControl{},
+			err:   ErrorInvalidCacheControl,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := make(http.Header)
+			for _, line := range tt.lines {
+				h.Add("Cache-Control", line)
+			}
+			cc, err := ParseCacheControl(h)
+			if tt.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.err)
+			}
+			assert.Equal(t, tt.cc, cc)
+		})
+	}
+}
+
+func TestCacheControlString(t *testing.T) {
+	cc := CacheControl{}
+	cc.Set("Max-Age", "60")
+	cc.Set("no-cache", "Set-Cookie")
+	cc.Set("public", "")
+	cc.Set("ext", `a "b"`)
+	assert.Equal(t, `ext="a \"b\"", max-age=60, no-cache="Set-Cookie", public`, cc.String())
+
+	h := make(http.Header)
+	h.Set("Cache-Control", cc.String())
+	parsed, err := ParseCacheControl(h)
+	assert.NoError(t, err)
+	assert.Equal(t, cc, parsed)
+
+	cc.Del("PUBLIC")
+	assert.Equal(t, `ext="a \"b\"", max-age=60, no-cache="Set-Cookie"`, cc.String())
+	assert.Equal(t, "", CacheControl{}.String())
+
+	cc = CacheControl{}
+	cc.Set("no-cache", "")
+	cc.Set("private", "")
+	assert.Equal(t, "no-cache, private", cc.String())
+}
+
+func TestCacheControlFieldNames(t *testing.T) {
+	h := make(http.Header)
+	h.Set("Cache-Control", `no-cache="set-cookie, X-Foo", private="authorization"`)
+	cc := newCacheControl(h)
+	assert.Equal(t, []string{"Set-Cookie", "X-Foo"}, cc.NoCacheFields())
+	assert.Equal(t, []string{"Authorization"}, cc.PrivateFields())
+
+	h.Set("Cache-Control", "no-cache, private")
+	cc = newCacheControl(h)
+	assert.Empty(t, cc.NoCacheFields())
+	assert.Empty(t, cc.PrivateFields())
+}
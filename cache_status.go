@@ -0,0 +1,103 @@
+package webcache
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCacheName identifies the cache in the Cache-Status header.
+const defaultCacheName = "webcache"
+
+// Reasons for forwarding a request to the origin.
+// https://www.rfc-editor.org/rfc/rfc9211#section-2.2
+const (
+	// fwdMethod means the method of the request must be forwarded, as for unsafe methods.
+	fwdMethod = "method"
+	// fwdURIMiss means no response is stored for the target URI.
+	fwdURIMiss = "uri-miss"
+	// fwdVaryMiss means responses are stored for the target URI, but none is selected by the request headers.
+	fwdVaryMiss = "vary-miss"
+	// fwdMiss means the stored response could not be used.
+	fwdMiss = "miss"
+	// fwdStale means the stored response was stale and had to be validated.
+	fwdStale = "stale"
+	// fwdRequest means the directives of the request forced a validation.
+	fwdRequest = "request"
+)
+
+// cacheStatus records how the cache handled a request, it is sent in the Cache-Status header.
+// https://www.rfc-editor.org/rfc/rfc9211
+type cacheStatus struct {
+	// hit is set when the response is served from the cache.
+	hit bool
+	// fwd is the reason why the request was forwarded to the origin, if it was.
+	fwd string
+	// fwdStatus is the status code of the response of the origin to the forwarded request.
+	fwdStatus int
+	// ttl is the remaining freshness lifetime of the response, it is negative once stale.
+	ttl    time.Duration
+	hasTTL bool
+	// stored is set when the response of the origin is stored by the time it is returned, as a response
+	// without body is. A response with a body is only stored once it is read, which is not reported.
+	stored bool
+	// storing is set when the response of the origin is handed to the cache, to be stored.
+	storing bool
+	// collapsed is set when the request was collapsed with another one for the same response.
+	collapsed bool
+	// served is set when a stored response is served although the request was forwarded,
+	// because the origin validated it or because its validation failed.
+	served bool
+}
+
+// fromCache reports whether the response is a stored response, served with or without validation.
+func (s cacheStatus) fromCache() bool {
+	return s.hit || s.served
+}
+
+func (s cacheStatus) String(name string) string {
+	params := []string{cacheStatusName(name)}
+	if s.hit {
+		params = append(params, "hit")
+	}
+	if s.fwd != "" {
+		params = append(params, "fwd="+s.fwd)
+	}
+	if s.fwdStatus != 0 {
+		params = append(params, "fwd-status="+strconv.Itoa(s.fwdStatus))
+	}
+	if s.hasTTL {
+		params = append(params, "ttl="+strconv.FormatInt(int64(s.ttl/time.Second), 10))
+	}
+	if s.stored {
+		params = append(params, "stored")
+	}
+	if s.collapsed {
+		params = append(params, "collapsed")
+	}
+	return strings.Join(params, "; ")
+}
+
+var sfToken = regexp.MustCompile("^[A-Za-z*][A-Za-z0-9:/!#$%&'*+.^_`|~-]*$")
+
+// cacheStatusName returns the name of the cache as a structured field token, or as a string when it is not a valid token.
+// https://www.rfc-editor.org/rfc/rfc8941#section-3.3.4
+func cacheStatusName(name string) string {
+	if sfToken.MatchString(name) {
+		return name
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// withCacheStatusHeader appends the status of this cache to the Cache-Status header,
+// after the entries of the caches closer to the origin.
+func withCacheStatusHeader(h http.Header, name string, status cacheStatus) http.Header {
+	headers := h.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Add("Cache-Status", status.String(name))
+	return headers
+}
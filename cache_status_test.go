@@ -0,0 +1,165 @@
+package webcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cacheStatusParams returns the parameters of the last member of the Cache-Status header,
+// the member added by the cache closest to the client.
+func cacheStatusParams(response *http.Response) map[string]string {
+	values := response.Header.Values("Cache-Status")
+	if len(values) == 0 {
+		return nil
+	}
+	members := strings.Split(values[len(values)-1], ",")
+	params := make(map[string]string)
+	for _, param := range strings.Split(members[len(members)-1], ";")[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		params[k] = v
+	}
+	return params
+}
+
+// servedFromCache reports whether the response is a stored response, either a hit or a response
+// freshened by the 304 response of the origin.
+func servedFromCache(response *http.Response) bool {
+	params := cacheStatusParams(response)
+	_, hit := params["hit"]
+	return hit || params["fwd-status"] == "304"
+}
+
+func TestCacheStatusString(t *testing.T) {
+	assert.Equal(t, "webcache; hit; ttl=30", cacheStatus{hit: true, ttl: 30 * time.Second, hasTTL: true}.String("webcache"))
+	assert.Equal(t, "webcache; fwd=uri-miss; fwd-status=200; ttl=60; stored", cacheStatus{fwd: fwdURIMiss, fwdStatus: 200, ttl: time.Minute, hasTTL: true, stored: true}.String("webcache"))
+	assert.Equal(t, "webcache; hit; ttl=-10; collapsed", cacheStatus{hit: true, ttl: -10 * time.Second, hasTTL: true, collapsed: true}.String("webcache"))
+	assert.Equal(t, `"my cache"; fwd=method`, cacheStatus{fwd: fwdMethod}.String("my cache"))
+}
+
+func TestRoundTripCacheStatus(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	origin := &invalidationOrigin{status: http.StatusNoContent}
+	transport := NewTransport(NewCache(), statusDateOrigin{clock: clock, next: origin}, WithClock(clock), WithCacheName("edge"))
+
+	get := func(accept string) *http.Request {
+		r, err := http.NewRequest(http.MethodGet, "http://example.com/items", nil)
+		assert.NoError(t, err)
+		r.Header.Set("Accept", accept)
+		return r
+	}
+
+	// the responses are only stored once their body is read, after Cache-Status is sent,
+	// the stored parameter is never sent for a response with a body
+	response, err := roundTripAndRead(t, transport, get("text/html"))
+	assert.NoError(t, err)
+	assert.Equal(t, "edge; fwd=uri-miss; fwd-status=200; ttl=60", response.Header.Get("Cache-Status"))
+
+	response, err = transport.RoundTrip(get("application/json"))
+	assert.NoError(t, err)
+	assert.Equal(t, "edge; fwd=vary-miss; fwd-status=200; ttl=60", response.Header.Get("Cache-Status"))
+	assert.NoError(t, response.Body.Close())
+
+	clock.Advance(20 * time.Second)
+	response, err = transport.RoundTrip(get("text/html"))
+	assert.NoError(t, err)
+	assert.Equal(t, "edge; hit; ttl=40", response.Header.Get("Cache-Status"))
+	assert.Empty(t, response.Header.Get("X-Cache"))
+
+	r := get("text/html")
+	r.Header.Set("Cache-Control", "no-cache")
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "edge; fwd=request; fwd-status=200; ttl=60", response.Header.Get("Cache-Status"))
+	assert.NoError(t, response.Body.Close())
+
+	clock.Advance(2 * time.Minute)
+	response, err = transport.RoundTrip(get("text/html"))
+	assert.NoError(t, err)
+	assert.Equal(t, "edge; fwd=stale; fwd-status=200; ttl=60", response.Header.Get("Cache-Status"))
+
+	r, err = http.NewRequest(http.MethodDelete, "http://example.com/items", nil)
+	assert.NoError(t, err)
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "edge; fwd=method; fwd-status=204", response.Header.Get("Cache-Status"))
+}
+
+func TestRoundTripCacheStatusStoredWithoutBody(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	header := make(http.Header)
+	header.Set("Cache-Control", "max-age=60")
+	header.Set("Date", clock.Now().Format(http.TimeFormat))
+	transport := NewTransport(NewCache(), &mockRoundTripper{
+		response: &http.Response{StatusCode: http.StatusNoContent, Header: header, Body: http.NoBody},
+	}, WithClock(clock))
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "webcache; fwd=uri-miss; fwd-status=204; ttl=60; stored", response.Header.Get("Cache-Status"))
+}
+
+func TestRoundTripXCacheHeader(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	origin := statusDateOrigin{clock: clock, next: &invalidationOrigin{}}
+	transport := NewTransport(NewCache(), origin, WithClock(clock), XCacheHeader(true))
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com/items", nil)
+	assert.NoError(t, err)
+	response, err := roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	assert.Empty(t, response.Header.Get("X-Cache"))
+
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.Equal(t, "webcache; hit; ttl=60", response.Header.Get("Cache-Status"))
+}
+
+func TestRoundTripOriginXCacheHeader(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Cache", "HIT")
+	transport := NewTransport(NewCache(), &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewReader([]byte("hello world"))),
+		},
+	})
+
+	// the X-Cache header of an upstream cache is neither taken for a hit nor removed
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	r.Header.Set("Range", "bytes=0-1")
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.Equal(t, "webcache; fwd=uri-miss; fwd-status=200", response.Header.Get("Cache-Status"))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+}
+
+// statusDateOrigin dates the responses of the next round tripper with the clock.
+type statusDateOrigin struct {
+	clock Clock
+	next  http.RoundTripper
+}
+
+func (o statusDateOrigin) RoundTrip(r *http.Request) (*http.Response, error) {
+	response, err := o.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	response.Header.Set("Date", o.clock.Now().Format(http.TimeFormat))
+	return response, nil
+}
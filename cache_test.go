@@ -33,3 +33,21 @@ func TestCache(t *testing.T) {
 	_, ok = c.Get(key.String())
 	assert.False(t, ok)
 }
+
+func TestCacheSetWithTTL(t *testing.T) {
+	clock := &mockClock{now: time.Now()}
+	c := &cache{clock: clock}
+
+	c.SetWithTTL("a", []byte("hello world"), time.Minute)
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+
+	clock.Advance(time.Minute)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+
+	c.SetWithTTL("a", []byte("hello world"), 0)
+	clock.Advance(time.Hour)
+	_, ok = c.Get("a")
+	assert.True(t, ok)
+}
@@ -0,0 +1,185 @@
+package webcache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultCollapseTimeout bounds how long collapsed requests wait for a streamed response to be stored,
+// before one of them is sent to the origin in its place.
+const defaultCollapseTimeout = time.Second
+
+// collapser tracks the requests in flight to the origin, by cache key.
+type collapser struct {
+	mu    sync.Mutex
+	calls map[string]*collapsedCall
+}
+
+// collapsedCall is a request in flight, that concurrent requests for the same key wait for.
+type collapsedCall struct {
+	// done is closed once the response is stored, or once it is known that it will not be
+	done chan struct{}
+	// expired is closed when the streamed response is still not stored once the collapse timeout elapsed,
+	// the call is then left to its leader and the requests waiting for it start another one
+	expired chan struct{}
+	timer   *time.Timer
+	waiters int
+	once    sync.Once
+}
+
+// join returns the call in flight for the key, or starts one. It reports true for the request that
+// starts the call, which must end it once its response is stored or discarded.
+func (c *collapser) join(key string) (*collapsedCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		return call, false
+	}
+	if c.calls == nil {
+		c.calls = make(map[string]*collapsedCall)
+	}
+	call := &collapsedCall{done: make(chan struct{}), expired: make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+// end removes the call, so that new requests for the key no longer wait for it, and wakes up the requests
+// waiting for it. It is called once the response is stored, so that no request finds neither the call
+// nor the stored response.
+func (c *collapser) end(key string, call *collapsedCall) {
+	call.once.Do(func() {
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		if call.timer != nil {
+			call.timer.Stop()
+		}
+		c.mu.Unlock()
+		close(call.done)
+	})
+}
+
+// stream starts the timeout of a call whose response is stored as its body is read. Once it elapses, new
+// requests for the key no longer join the call, and the requests waiting for it are woken up to start
+// another one.
+func (c *collapser) stream(key string, call *collapsedCall, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call.timer = time.AfterFunc(timeout, func() {
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.mu.Unlock()
+		close(call.expired)
+	})
+}
+
+// wait waits for the call to end, it reports false when the call expired before.
+func (call *collapsedCall) wait(ctx context.Context) (bool, error) {
+	select {
+	case <-call.done:
+		return true, nil
+	case <-call.expired:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// collapse sends the first request for a key to the origin with forward. Concurrent requests for the
+// same key wait for it, and are then answered from the cache with their own copy of the stored response.
+// When the response was not stored, because it is uncacheable or private, or when it does not match
+// their own request, the waiting requests are replayed with forward one by one. They are replayed as well
+// When the body of the response is not stored within the collapse timeout, as for a large or slow download,
+// the waiting requests collapse again: one of them is sent to the origin, and the others wait for it.
+func (t *Transport) collapse(r *http.Request, status *cacheStatus, forward func() (*http.Response, error)) (*http.Response, error) {
+	key := buildCacheKey(r).String()
+	for {
+		call, leader := t.collapser.join(key)
+		if leader {
+			response, err := forward()
+			if err != nil || !status.storing || status.stored {
+				t.collapser.end(key, call)
+				return response, err
+			}
+			// the response is stored as its body is read, the call ends once it is stored or discarded
+			response.Body = &releasingBody{ReadCloser: response.Body, release: func() { t.collapser.end(key, call) }}
+			t.collapser.stream(key, call, t.collapseTimeout)
+			return response, nil
+		}
+
+		ended, err := call.wait(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		// the response of the call, or of a call that took the place of an expired one, may be stored by now
+		if response, ok := t.collapsedResponse(r, status); ok {
+			return response, nil
+		}
+		if ended {
+			return forward()
+		}
+	}
+}
+
+// collapsedResponse returns the stored response for a request that was collapsed, if it can be used.
+func (t *Transport) collapsedResponse(r *http.Request, status *cacheStatus) (*http.Response, bool) {
+	response, ok := t.cache.Get(r)
+	if !ok {
+		return nil, false
+	}
+	fresh, ok := t.serveFresh(r, response)
+	if !ok {
+		response.Body.Close()
+		return nil, false
+	}
+	status.hit = true
+	status.collapsed = true
+	return fresh, true
+}
+
+// releasingBody calls release once the body is read up to its end, reading fails, or it is closed.
+// The body it wraps is stored when it is read up to its end or closed, release is called after that.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// serveFresh prepares a stored response for the request, when it can be used without validation.
+func (t *Transport) serveFresh(r *http.Request, response *http.Response) (*http.Response, bool) {
+	cacheControl := newCacheControl(response.Header)
+	freshness, err := t.freshnessChecker.Freshness(r.Context(), response.Header, cacheControl)
+	if err != nil {
+		return nil, false
+	}
+	if t.freshnessPolicy.requestedFreshness(freshness, response.Header, cacheControl, newCacheControl(r.Header), t.clock) != FreshnessFresh {
+		return nil, false
+	}
+
+	if freshness == FreshnessStale {
+		return t.serveStale(response), true
+	}
+	return t.serveStored(response), true
+}
@@ -0,0 +1,194 @@
+package webcache
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollapser(t *testing.T) {
+	var c collapser
+	call, leader := c.join("a")
+	assert.True(t, leader)
+	waiting, leader := c.join("a")
+	assert.False(t, leader)
+	assert.Same(t, call, waiting)
+	_, leader = c.join("b")
+	assert.True(t, leader)
+
+	c.end("a", call)
+	<-waiting.done
+	next, leader := c.join("a")
+	assert.True(t, leader)
+
+	// a call that ended does not end the next one for the key
+	c.end("a", call)
+	_, leader = c.join("a")
+	assert.False(t, leader)
+	c.end("a", next)
+}
+
+// collapsedRoundTrips sends n concurrent requests through the transport and releases the origin
+// once all but the first are waiting on it.
+func collapsedRoundTrips(t *testing.T, transport *Transport, origin *blockingRoundTripper, n int) []*http.Response {
+	responses := make([]*http.Response, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			assert.NoError(t, err)
+			response, err := roundTripAndRead(t, transport, r)
+			assert.NoError(t, err)
+			responses[i] = response
+		}(i)
+	}
+
+	key := cacheKey("cache_key=GET_http://example.com").String()
+	assert.Eventually(t, func() bool {
+		transport.collapser.mu.Lock()
+		defer transport.collapser.mu.Unlock()
+		call, ok := transport.collapser.calls[key]
+		return ok && call.waiters == n-1
+	}, time.Second, time.Millisecond)
+	close(origin.release)
+	wg.Wait()
+	return responses
+}
+
+func TestRoundTripCollapsesConcurrentMisses(t *testing.T) {
+	origin := &blockingRoundTripper{release: make(chan struct{}), header: make(http.Header)}
+	origin.header.Set("Cache-Control", "max-age=60")
+	origin.header.Set("Date", time.Now().Format(http.TimeFormat))
+	transport := NewTransport(NewCache(), origin)
+
+	responses := collapsedRoundTrips(t, transport, origin, 5)
+	assert.Equal(t, int32(1), origin.calls.Load())
+
+	collapsed := 0
+	for _, response := range responses {
+		if _, ok := cacheStatusParams(response)["collapsed"]; ok {
+			collapsed++
+		}
+		body, err := io.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "fresh", string(body))
+	}
+	assert.Equal(t, 4, collapsed)
+}
+
+func TestRoundTripReplaysCollapsedUncacheableResponse(t *testing.T) {
+	origin := &blockingRoundTripper{release: make(chan struct{}), header: make(http.Header)}
+	origin.header.Set("Cache-Control", "private, max-age=60")
+	origin.header.Set("Date", time.Now().Format(http.TimeFormat))
+	transport := NewTransport(NewCache(), origin)
+
+	responses := collapsedRoundTrips(t, transport, origin, 3)
+	assert.Equal(t, int32(3), origin.calls.Load())
+	for _, response := range responses {
+		assert.False(t, servedFromCache(response))
+		body, err := io.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "fresh", string(body))
+	}
+}
+
+func TestRoundTripCollapsesRequestsUntilResponseIsStored(t *testing.T) {
+	origin := &blockingRoundTripper{release: make(chan struct{}), header: make(http.Header)}
+	origin.header.Set("Cache-Control", "max-age=60")
+	origin.header.Set("Date", time.Now().Format(http.TimeFormat))
+	close(origin.release)
+	transport := NewTransport(NewCache(), origin)
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+
+	// a request arriving while the first response is read waits for it to be stored
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	collapsed := make(chan *http.Response)
+	go func() {
+		response, err := roundTripAndRead(t, transport, r)
+		assert.NoError(t, err)
+		collapsed <- response
+	}()
+	assert.Eventually(t, func() bool {
+		transport.collapser.mu.Lock()
+		defer transport.collapser.mu.Unlock()
+		return transport.collapser.calls[buildCacheKey(r).String()].waiters == 1
+	}, time.Second, time.Millisecond)
+
+	_, err = io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, response.Body.Close())
+	response = <-collapsed
+	assert.Equal(t, "webcache; hit; ttl=60; collapsed", response.Header.Get("Cache-Status"))
+	assert.Equal(t, int32(1), origin.calls.Load())
+}
+
+func TestRoundTripCollapseTimeout(t *testing.T) {
+	origin := &blockingRoundTripper{release: make(chan struct{}), header: make(http.Header)}
+	origin.header.Set("Cache-Control", "max-age=60")
+	origin.header.Set("Date", time.Now().Format(http.TimeFormat))
+	close(origin.release)
+	transport := NewTransport(NewCache(), origin, WithCollapseTimeout(10*time.Millisecond))
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+
+	// the body of the first response is never read, the next request is sent to the origin
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	defer response.Body.Close()
+	// later requests no longer wait for it
+	assert.Eventually(t, func() bool {
+		transport.collapser.mu.Lock()
+		defer transport.collapser.mu.Unlock()
+		_, ok := transport.collapser.calls[buildCacheKey(r).String()]
+		return !ok
+	}, time.Second, time.Millisecond)
+	next, err := roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	assert.False(t, servedFromCache(next))
+	assert.Equal(t, int32(2), origin.calls.Load())
+}
+
+func TestRoundTripCollapseTimeoutSendsOneRequest(t *testing.T) {
+	origin := &blockingRoundTripper{release: make(chan struct{}), header: make(http.Header)}
+	origin.header.Set("Cache-Control", "max-age=60")
+	origin.header.Set("Date", time.Now().Format(http.TimeFormat))
+	close(origin.release)
+	transport := NewTransport(NewCache(), origin, WithCollapseTimeout(50*time.Millisecond))
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+
+	// the body of the first response is never read, once the timeout elapses a single request takes its place
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	defer response.Body.Close()
+
+	responses := make([]*http.Response, 10)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, err := roundTripAndRead(t, transport, r.Clone(r.Context()))
+			assert.NoError(t, err)
+			responses[i] = response
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), origin.calls.Load())
+
+	collapsed := 0
+	for _, response := range responses {
+		if _, ok := cacheStatusParams(response)["collapsed"]; ok {
+			collapsed++
+		}
+	}
+	assert.Equal(t, 9, collapsed)
+}
@@ -0,0 +1,123 @@
+package webcache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// notModifiedHeaders are the header fields of a stored response that are sent in a 304 response.
+// https://www.rfc-editor.org/rfc/rfc9110#section-15.4.5
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Vary",
+	"Age",
+	"Warning",
+}
+
+// serveConditional answers the conditional request of a client from a stored response.
+// When the stored response satisfies If-None-Match, or If-Modified-Since if there is no If-None-Match,
+// a 304 response is returned in place of the stored response.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.3.2
+func serveConditional(r *http.Request, response *http.Response) *http.Response {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return response
+	}
+	if response.StatusCode != http.StatusOK || !isNotModified(r, response.Header) {
+		return response
+	}
+
+	response.Body.Close()
+	header := make(http.Header)
+	for _, k := range notModifiedHeaders {
+		if v, ok := response.Header[http.CanonicalHeaderKey(k)]; ok {
+			header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", http.StatusNotModified, http.StatusText(http.StatusNotModified)),
+		StatusCode: http.StatusNotModified,
+		Proto:      response.Proto,
+		ProtoMajor: response.ProtoMajor,
+		ProtoMinor: response.ProtoMinor,
+		Header:     header,
+		Body:       http.NoBody,
+		Request:    r,
+	}
+}
+
+// isNotModified evaluates the If-None-Match and If-Modified-Since preconditions of the request against
+// the stored response, it reports true when the client already has the selected representation.
+// https://www.rfc-editor.org/rfc/rfc9110#section-13.2.2
+func isNotModified(r *http.Request, header http.Header) bool {
+	if ifNoneMatch := r.Header.Values("If-None-Match"); len(ifNoneMatch) > 0 {
+		etag, err := etagFromHeader(header)
+		for _, tag := range parseEntityTags(strings.Join(ifNoneMatch, ",")) {
+			if tag == "*" || err == nil && weakMatch(tag, etag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince := r.Header.Get("If-Modified-Since")
+	if ifModifiedSince == "" {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	// without Last-Modified, the response is assumed to be modified at its Date
+	lastModified, err := lastModifiedFromHeader(header)
+	if err != nil {
+		if lastModified, err = dateFromHeader(header); err != nil {
+			return false
+		}
+	}
+	return !lastModified.After(since)
+}
+
+// parseEntityTags returns the entity tags of an If-None-Match or If-Match value, "*" included.
+// The entity tags keep their weakness indicator and quotes, and may contain commas.
+// https://www.rfc-editor.org/rfc/rfc9110#section-8.8.3
+func parseEntityTags(s string) []string {
+	var tags []string
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return tags
+		}
+		if s[0] == '*' {
+			tags = append(tags, "*")
+			s = s[1:]
+			continue
+		}
+
+		prefix := ""
+		if strings.HasPrefix(s, "W/") {
+			prefix, s = "W/", s[2:]
+		}
+		if s == "" || s[0] != '"' {
+			// an invalid member, skipped up to the next one
+			_, s, _ = strings.Cut(s, ",")
+			continue
+		}
+		end := strings.IndexByte(s[1:], '"')
+		if end < 0 {
+			return tags
+		}
+		tags = append(tags, prefix+s[:end+2])
+		s = s[end+2:]
+	}
+}
+
+// weakMatch compares two entity tags with the weak comparison, ignoring their weakness indicators.
+// https://www.rfc-editor.org/rfc/rfc9110#section-8.8.3.2
+func weakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
@@ -0,0 +1,95 @@
+package webcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEntityTags(t *testing.T) {
+	assert.Equal(t, []string{`"a"`, `W/"b"`, `"c,d"`}, parseEntityTags(`"a", W/"b" ,"c,d"`))
+	assert.Equal(t, []string{"*"}, parseEntityTags("*"))
+	assert.Equal(t, []string{`"b"`}, parseEntityTags(`a, "b"`))
+	assert.Empty(t, parseEntityTags(""))
+}
+
+func TestIsNotModified(t *testing.T) {
+	lastModified := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	header := make(http.Header)
+	header.Set("ETag", `W/"a"`)
+	header.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	tests := []struct {
+		name            string
+		ifNoneMatch     string
+		ifModifiedSince time.Time
+		notModified     bool
+	}{
+		{name: "no precondition"},
+		{name: "weak match", ifNoneMatch: `"a"`, notModified: true},
+		{name: "one of many", ifNoneMatch: `"b", W/"a"`, notModified: true},
+		{name: "wildcard", ifNoneMatch: "*", notModified: true},
+		{name: "no match", ifNoneMatch: `"b"`},
+		{name: "if-none-match takes precedence", ifNoneMatch: `"b"`, ifModifiedSince: lastModified},
+		{name: "not modified since", ifModifiedSince: lastModified, notModified: true},
+		{name: "modified since", ifModifiedSince: lastModified.Add(-time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			assert.NoError(t, err)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if !tt.ifModifiedSince.IsZero() {
+				r.Header.Set("If-Modified-Since", tt.ifModifiedSince.Format(http.TimeFormat))
+			}
+			assert.Equal(t, tt.notModified, isNotModified(r, header))
+		})
+	}
+}
+
+func TestRoundTripAnswersConditionalRequestLocally(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Cache-Control", "max-age=60")
+	header.Set("Date", time.Now().Format(http.TimeFormat))
+	header.Set("ETag", `"a"`)
+	header.Set("Content-Type", "text/plain")
+	origin := &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewReader([]byte("hello"))),
+		},
+	}
+	transport := NewTransport(NewCache(), origin)
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+
+	r.Header.Set("If-None-Match", `W/"a"`)
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotModified, response.StatusCode)
+	assert.Equal(t, `"a"`, response.Header.Get("ETag"))
+	assert.Equal(t, "max-age=60", response.Header.Get("Cache-Control"))
+	assert.Empty(t, response.Header.Get("Content-Type"))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Empty(t, body)
+
+	r.Header.Set("If-None-Match", `"b"`)
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	body, err = io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, 1, origin.calls)
+}
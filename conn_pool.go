@@ -0,0 +1,69 @@
+package webcache
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+// connPool keeps idle connections to a network cache server for reuse.
+type connPool struct {
+	addr        string
+	dialTimeout time.Duration
+	ioTimeout   time.Duration
+	idle        chan *poolConn
+}
+
+type poolConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newConnPool(addr string, size int, dialTimeout, ioTimeout time.Duration) *connPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &connPool{
+		addr:        addr,
+		dialTimeout: dialTimeout,
+		ioTimeout:   ioTimeout,
+		idle:        make(chan *poolConn, size),
+	}
+}
+
+// get returns an idle connection, or dials a new one when none is available.
+func (p *connPool) get() (*poolConn, error) {
+	var c *poolConn
+	select {
+	case c = <-p.idle:
+	default:
+		conn, err := net.DialTimeout("tcp", p.addr, p.dialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		c = &poolConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	}
+
+	if p.ioTimeout > 0 {
+		if err := c.SetDeadline(time.Now().Add(p.ioTimeout)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns the connection to the pool.
+// A connection that failed is closed instead, since its stream may be out of sync.
+func (p *connPool) put(c *poolConn, err error) {
+	if err != nil {
+		c.Close()
+		return
+	}
+	select {
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+}
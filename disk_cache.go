@@ -0,0 +1,489 @@
+package webcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCorruptedEntry = errors.New("corrupted cache entry")
+)
+
+// diskEntryMagic identifies files written by the disk cache.
+var diskEntryMagic = [4]byte{'W', 'C', 'D', '1'}
+
+// diskStreamMagic identifies the files of the entries written as streams by the disk cache.
+// Their value is a diskStreamHeader followed by the name of the body file and by the metadata.
+var diskStreamMagic = [4]byte{'W', 'C', 'S', '1'}
+
+// diskEntryHeader is the fixed size header at the start of every entry file.
+// It is followed by the key and then by the value.
+type diskEntryHeader struct {
+	Magic [4]byte
+	// Expires is the expiry of the entry in unix nanoseconds, zero when it does not expire.
+	Expires  int64
+	KeyLen   uint32
+	ValueLen uint64
+	Sum      [sha256.Size]byte
+}
+
+var diskEntryHeaderSize = binary.Size(diskEntryHeader{})
+
+// diskStreamHeader describes the body of an entry written as a stream, which is kept in its own file
+// next to the entry file.
+type diskStreamHeader struct {
+	BodyLen uint64
+	BodySum [sha256.Size]byte
+	NameLen uint16
+}
+
+var diskStreamHeaderSize = binary.Size(diskStreamHeader{})
+
+// diskOrphanAge is how long a temporary file or a body file that no entry refers to is left alone, as it may
+// still be written by another process, before it is removed as left behind by a process that stopped.
+const diskOrphanAge = time.Hour
+
+type diskCache struct {
+	dir   string
+	clock Clock
+	// mu serializes the replacement of entries, so that the body file of a replaced stream entry is removed
+	mu sync.Mutex
+	// writing holds the body files being written, that no entry refers to yet
+	writing map[string]bool
+}
+
+// NewDiskCache returns a Cache that keeps every entry in its own file under dir,
+// so that entries survive process restarts.
+// Entries are written to a temporary file and renamed into place, hence readers
+// never observe a partially written entry.
+// The cache is also a StreamingCache, whose entries keep their body in a file of its own.
+// The files left behind by a process that stopped while writing are removed.
+func NewDiskCache(dir string) (Cache[string, []byte], error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &diskCache{dir: dir, clock: NewClock(), writing: make(map[string]bool)}
+	c.removeOrphans()
+	return c, nil
+}
+
+func (c *diskCache) Get(key string) ([]byte, bool) {
+	b, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	value, expires, err := decodeDiskEntry(diskEntryMagic, key, b)
+	if err != nil {
+		// a corrupted or truncated entry is a miss, and is removed so it gets rewritten
+		if errors.Is(err, ErrCorruptedEntry) {
+			c.removeCorrupted(key)
+		}
+		return nil, false
+	}
+	if expired(expires, c.clock) {
+		_ = os.Remove(c.path(key))
+		return nil, false
+	}
+	return value, true
+}
+
+func (c *diskCache) Set(key string, value []byte) {
+	c.SetWithTTL(key, value, 0)
+}
+
+func (c *diskCache) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	_ = c.replace(key, encodeDiskEntry(diskEntryMagic, key, value, expiresAfter(ttl, c.clock)))
+}
+
+func (c *diskCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	body, ok := c.streamBody(key)
+	_ = os.Remove(c.path(key))
+	if ok {
+		_ = os.Remove(body)
+	}
+}
+
+// PutStream writes the body of the entry to a file of its own, the entry is written once the body is committed.
+func (c *diskCache) PutStream(key string, metadata []byte) (EntryWriter, error) {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".body-*")
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.writing[f.Name()] = true
+	c.mu.Unlock()
+	return &diskEntryWriter{c: c, key: key, metadata: metadata, f: f, hash: sha256.New()}, nil
+}
+
+// GetStream returns the metadata of the entry and a reader of its body file. Reading the body fails with
+// ErrCorruptedEntry if it does not match the body that was written.
+func (c *diskCache) GetStream(key string) ([]byte, io.ReadCloser, bool) {
+	b, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, nil, false
+	}
+
+	header, body, metadata, err := c.decodeStream(key, b)
+	if err != nil {
+		if errors.Is(err, ErrCorruptedEntry) {
+			c.removeCorrupted(key)
+		}
+		return nil, nil, false
+	}
+	f, err := os.Open(body)
+	if err != nil {
+		return nil, nil, false
+	}
+	return metadata, &diskBodyReader{f: f, hash: sha256.New(), length: header.BodyLen, remaining: header.BodyLen, sum: header.BodySum}, true
+}
+
+// UpdateMetadata rewrites the entry file with the metadata, the body file is kept.
+func (c *diskCache) UpdateMetadata(key string, metadata []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return err
+	}
+	header, body, _, err := c.decodeStream(key, b)
+	if err != nil {
+		return err
+	}
+	return c.write(key, encodeStreamEntry(key, header, filepath.Base(body), metadata))
+}
+
+// removeCorrupted removes a corrupted entry file along with the body files of the key, the name of its body file
+// cannot be trusted. The body files being written are kept.
+func (c *diskCache) removeCorrupted(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := c.path(key)
+	_ = os.Remove(path)
+	bodies, _ := filepath.Glob(path + ".body-*")
+	for _, body := range bodies {
+		if !c.writing[body] {
+			_ = os.Remove(body)
+		}
+	}
+}
+
+// removeOrphans removes the temporary files and the body files that no entry refers to, once they are older
+// than diskOrphanAge.
+func (c *diskCache) removeOrphans() {
+	cutoff := c.clock.Now().Add(-diskOrphanAge)
+	_ = filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		if !strings.HasPrefix(name, ".tmp-") && (!strings.Contains(name, ".body-") || c.referenced(path)) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().Before(cutoff) {
+			_ = os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// referenced reports whether the body file is the body of the entry it is named after.
+func (c *diskCache) referenced(body string) bool {
+	name := filepath.Base(body)
+	entry := filepath.Join(filepath.Dir(body), name[:strings.Index(name, ".body-")])
+	b, err := os.ReadFile(entry)
+	if err != nil {
+		return false
+	}
+	key, ok := diskEntryKey(b)
+	if !ok {
+		return false
+	}
+	_, stored, _, err := c.decodeStream(key, b)
+	return err == nil && stored == body
+}
+
+// replace writes the entry file of the key, and removes the body file of the entry it replaces.
+func (c *diskCache) replace(key string, b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	body, ok := c.streamBody(key)
+	if err := c.write(key, b); err != nil {
+		return err
+	}
+	if ok {
+		_ = os.Remove(body)
+	}
+	return nil
+}
+
+// streamBody returns the path of the body file of the entry, when it is written as a stream.
+func (c *diskCache) streamBody(key string) (string, bool) {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	// the value of an entry that is not a stream is not read
+	var header diskEntryHeader
+	if err := binary.Read(f, binary.BigEndian, &header); err != nil || header.Magic != diskStreamMagic {
+		return "", false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", false
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return "", false
+	}
+	_, body, _, err := c.decodeStream(key, b)
+	return body, err == nil
+}
+
+// decodeStream returns the header, the path of the body file and the metadata of an entry written as a stream.
+func (c *diskCache) decodeStream(key string, b []byte) (diskStreamHeader, string, []byte, error) {
+	value, _, err := decodeDiskEntry(diskStreamMagic, key, b)
+	if err != nil {
+		return diskStreamHeader{}, "", nil, err
+	}
+
+	var header diskStreamHeader
+	if err := binary.Read(bytes.NewReader(value), binary.BigEndian, &header); err != nil {
+		return diskStreamHeader{}, "", nil, ErrCorruptedEntry
+	}
+	rest := value[diskStreamHeaderSize:]
+	if len(rest) < int(header.NameLen) {
+		return diskStreamHeader{}, "", nil, ErrCorruptedEntry
+	}
+	body := filepath.Join(filepath.Dir(c.path(key)), string(rest[:header.NameLen]))
+	return header, body, rest[header.NameLen:], nil
+}
+
+func (c *diskCache) write(key string, b []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// path returns the location of the entry for the key.
+// Keys are hashed, and the first bytes of the hash are used as directories
+// to keep the number of files per directory small.
+func (c *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[0:2], name[2:4], name)
+}
+
+func encodeDiskEntry(magic [4]byte, key string, value []byte, expires time.Time) []byte {
+	header := diskEntryHeader{
+		Magic:    magic,
+		Expires:  unixNanoOrZero(expires),
+		KeyLen:   uint32(len(key)),
+		ValueLen: uint64(len(value)),
+		Sum:      sha256.Sum256(value),
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, diskEntryHeaderSize+len(key)+len(value)))
+	_ = binary.Write(buf, binary.BigEndian, header)
+	buf.WriteString(key)
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+// diskEntryKey returns the key an entry file was written for.
+func diskEntryKey(b []byte) (string, bool) {
+	var header diskEntryHeader
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &header); err != nil {
+		return "", false
+	}
+	rest := b[diskEntryHeaderSize:]
+	if uint64(len(rest)) < uint64(header.KeyLen) {
+		return "", false
+	}
+	return string(rest[:header.KeyLen]), true
+}
+
+func decodeDiskEntry(magic [4]byte, key string, b []byte) ([]byte, time.Time, error) {
+	var header diskEntryHeader
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &header); err != nil {
+		return nil, time.Time{}, ErrCorruptedEntry
+	}
+	// an entry written as a value is not an entry written as a stream, and conversely
+	if header.Magic == diskEntryMagic && magic != diskEntryMagic || header.Magic == diskStreamMagic && magic != diskStreamMagic {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	if header.Magic != magic {
+		return nil, time.Time{}, ErrCorruptedEntry
+	}
+
+	rest := b[diskEntryHeaderSize:]
+	if uint64(len(rest)) != uint64(header.KeyLen)+header.ValueLen {
+		return nil, time.Time{}, ErrCorruptedEntry
+	}
+
+	// the file belongs to another key with the same hash
+	if string(rest[:header.KeyLen]) != key {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+
+	value := rest[header.KeyLen:]
+	if sha256.Sum256(value) != header.Sum {
+		return nil, time.Time{}, ErrCorruptedEntry
+	}
+
+	var expires time.Time
+	if header.Expires != 0 {
+		expires = time.Unix(0, header.Expires)
+	}
+	return value, expires, nil
+}
+
+// encodeStreamEntry returns the entry file of an entry written as a stream, whose body is in the file name.
+func encodeStreamEntry(key string, header diskStreamHeader, name string, metadata []byte) []byte {
+	header.NameLen = uint16(len(name))
+	buf := bytes.NewBuffer(make([]byte, 0, diskStreamHeaderSize+len(name)+len(metadata)))
+	_ = binary.Write(buf, binary.BigEndian, header)
+	buf.WriteString(name)
+	buf.Write(metadata)
+	return encodeDiskEntry(diskStreamMagic, key, buf.Bytes(), time.Time{})
+}
+
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// diskEntryWriter writes the body of an entry to its body file, and the entry file once it is committed.
+type diskEntryWriter struct {
+	c        *diskCache
+	key      string
+	metadata []byte
+	f        *os.File
+	hash     hash.Hash
+	n        uint64
+	done     bool
+}
+
+func (w *diskEntryWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.hash.Write(p[:n])
+	w.n += uint64(n)
+	return n, err
+}
+
+func (w *diskEntryWriter) Commit() error {
+	if w.done {
+		return os.ErrClosed
+	}
+	w.done = true
+	defer w.written()
+
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+
+	header := diskStreamHeader{BodyLen: w.n}
+	copy(header.BodySum[:], w.hash.Sum(nil))
+	if err := w.c.replace(w.key, encodeStreamEntry(w.key, header, filepath.Base(w.f.Name()), w.metadata)); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return nil
+}
+
+// written removes the body file from the files being written, once the entry refers to it or it is removed.
+func (w *diskEntryWriter) written() {
+	w.c.mu.Lock()
+	delete(w.c.writing, w.f.Name())
+	w.c.mu.Unlock()
+}
+
+func (w *diskEntryWriter) Abort() error {
+	if w.done {
+		return os.ErrClosed
+	}
+	w.done = true
+	defer w.written()
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// diskBodyReader reads the body file of an entry, and checks it against the length and sum it was written with.
+type diskBodyReader struct {
+	f         *os.File
+	hash      hash.Hash
+	length    uint64
+	remaining uint64
+	sum       [sha256.Size]byte
+}
+
+func (r *diskBodyReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.hash.Write(p[:n])
+	if uint64(n) > r.remaining {
+		return n, ErrCorruptedEntry
+	}
+	r.remaining -= uint64(n)
+	if err == io.EOF && (r.remaining != 0 || !bytes.Equal(r.hash.Sum(nil), r.sum[:])) {
+		return n, ErrCorruptedEntry
+	}
+	return n, err
+}
+
+func (r *diskBodyReader) size() int64 {
+	return int64(r.length)
+}
+
+func (r *diskBodyReader) Close() error {
+	return r.f.Close()
+}
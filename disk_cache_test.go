@@ -0,0 +1,335 @@
+package webcache
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCache(t *testing.T) {
+	c, err := NewDiskCache(t.TempDir())
+	assert.NoError(t, err)
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	c.Set("a", []byte("hello world"))
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), v)
+
+	c.Set("a", []byte("hello again"))
+	v, ok = c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello again"), v)
+
+	c.Delete("a")
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+}
+
+func TestDiskCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir)
+	assert.NoError(t, err)
+	c.Set("a", []byte("hello world"))
+
+	c, err = NewDiskCache(dir)
+	assert.NoError(t, err)
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), v)
+}
+
+func TestDiskCacheCorruptedEntryIsMiss(t *testing.T) {
+	c, err := NewDiskCache(t.TempDir())
+	assert.NoError(t, err)
+	path := c.(*diskCache).path("a")
+
+	c.Set("a", []byte("hello world"))
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	b[len(b)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, b, 0o644))
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	c.Set("a", []byte("hello world"))
+	b, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, b[:len(b)-3], 0o644))
+
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+
+	assert.NoError(t, os.WriteFile(path, []byte("abc"), 0o644))
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+}
+
+func TestDiskCacheConcurrentAccess(t *testing.T) {
+	c, err := NewDiskCache(t.TempDir())
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				key := fmt.Sprintf("key-%d", j%4)
+				c.Set(key, []byte(key))
+				if v, ok := c.Get(key); ok {
+					assert.Equal(t, key, string(v))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for j := 0; j < 4; j++ {
+		key := fmt.Sprintf("key-%d", j)
+		v, ok := c.Get(key)
+		assert.True(t, ok)
+		assert.Equal(t, key, string(v))
+	}
+}
+
+func TestDiskCacheSetWithTTL(t *testing.T) {
+	c, err := NewDiskCache(t.TempDir())
+	assert.NoError(t, err)
+	clock := &mockClock{now: time.Now()}
+	c.(*diskCache).clock = clock
+
+	c.(ExpiringCache[string, []byte]).SetWithTTL("a", []byte("hello world"), time.Minute)
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+
+	clock.Advance(time.Minute)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+	_, err = os.Stat(c.(*diskCache).path("a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDiskCacheStream(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir)
+	assert.NoError(t, err)
+	stream := c.(StreamingCache)
+
+	w, err := stream.PutStream("a", []byte("metadata"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello "))
+	assert.NoError(t, err)
+	_, _, ok := stream.GetStream("a")
+	assert.False(t, ok)
+	_, err = w.Write([]byte("world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Commit())
+	assert.ErrorIs(t, w.Abort(), os.ErrClosed)
+
+	assertStreamEntry(t, stream, "a", "metadata", "hello world")
+	// an entry written as a stream is not a value of the cache
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+
+	w, err = stream.PutStream("a", []byte("metadata again"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello again"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Commit())
+	assertStreamEntry(t, stream, "a", "metadata again", "hello again")
+	assert.Equal(t, 2, countFiles(t, dir))
+
+	c.Set("a", []byte("value"))
+	_, _, ok = stream.GetStream("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, countFiles(t, dir))
+
+	w, err = stream.PutStream("a", []byte("metadata"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Commit())
+	c.Delete("a")
+	_, _, ok = stream.GetStream("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, countFiles(t, dir))
+}
+
+func TestDiskCacheStreamUpdateMetadata(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir)
+	assert.NoError(t, err)
+	stream := c.(StreamingCache)
+
+	w, err := stream.PutStream("a", []byte("metadata"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Commit())
+	body, ok := c.(*diskCache).streamBody("a")
+	assert.True(t, ok)
+
+	// the body file is kept
+	assert.NoError(t, stream.UpdateMetadata("a", []byte("updated")))
+	assertStreamEntry(t, stream, "a", "updated", "hello world")
+	updated, ok := c.(*diskCache).streamBody("a")
+	assert.True(t, ok)
+	assert.Equal(t, body, updated)
+	assert.Equal(t, 2, countFiles(t, dir))
+
+	assert.ErrorIs(t, stream.UpdateMetadata("b", []byte("metadata")), os.ErrNotExist)
+	// a value is not a stream
+	c.Set("b", []byte("value"))
+	assert.Error(t, stream.UpdateMetadata("b", []byte("metadata")))
+}
+
+func TestDiskCacheStreamAbort(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir)
+	assert.NoError(t, err)
+	stream := c.(StreamingCache)
+
+	w, err := stream.PutStream("a", []byte("metadata"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Commit())
+
+	w, err = stream.PutStream("a", []byte("other"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Abort())
+	assert.ErrorIs(t, w.Commit(), os.ErrClosed)
+
+	assertStreamEntry(t, stream, "a", "metadata", "hello world")
+	assert.Equal(t, 2, countFiles(t, dir))
+}
+
+func TestDiskCacheStreamCorruptedBody(t *testing.T) {
+	c, err := NewDiskCache(t.TempDir())
+	assert.NoError(t, err)
+	stream := c.(StreamingCache)
+
+	w, err := stream.PutStream("a", []byte("metadata"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Commit())
+
+	body, ok := c.(*diskCache).streamBody("a")
+	assert.True(t, ok)
+	assert.NoError(t, os.WriteFile(body, []byte("hello there"), 0o644))
+
+	_, r, ok := stream.GetStream("a")
+	assert.True(t, ok)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrCorruptedEntry)
+	assert.NoError(t, r.Close())
+}
+
+func TestDiskCacheStreamCorruptedEntry(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir)
+	assert.NoError(t, err)
+	stream := c.(StreamingCache)
+
+	w, err := stream.PutStream("a", []byte("metadata"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Commit())
+
+	// a body being written for the key is kept
+	pending, err := stream.PutStream("a", []byte("metadata"))
+	assert.NoError(t, err)
+
+	path := c.(*diskCache).path("a")
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	b[len(b)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, b, 0o644))
+
+	// the entry is removed along with its body
+	_, _, ok := stream.GetStream("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, countFiles(t, dir))
+
+	_, err = pending.Write([]byte("hello again"))
+	assert.NoError(t, err)
+	assert.NoError(t, pending.Commit())
+	assertStreamEntry(t, stream, "a", "metadata", "hello again")
+}
+
+func TestNewDiskCacheRemovesOrphans(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir)
+	assert.NoError(t, err)
+	stream := c.(StreamingCache)
+
+	w, err := stream.PutStream("a", []byte("metadata"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Commit())
+	body, ok := c.(*diskCache).streamBody("a")
+	assert.True(t, ok)
+
+	// the files of a process that stopped while writing, and a body still written by another one
+	path := c.(*diskCache).path("b")
+	orphans := []string{path + ".body-1", filepath.Join(filepath.Dir(path), ".tmp-1")}
+	written := path + ".body-2"
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	for _, name := range append(orphans, written) {
+		assert.NoError(t, os.WriteFile(name, []byte("hello"), 0o644))
+	}
+	old := time.Now().Add(-2 * diskOrphanAge)
+	for _, name := range append(orphans, body) {
+		assert.NoError(t, os.Chtimes(name, old, old))
+	}
+
+	c, err = NewDiskCache(dir)
+	assert.NoError(t, err)
+	for _, name := range orphans {
+		assert.NoFileExists(t, name)
+	}
+	assert.FileExists(t, written)
+	assertStreamEntry(t, c.(StreamingCache), "a", "metadata", "hello world")
+}
+
+func assertStreamEntry(t *testing.T, stream StreamingCache, key, metadata, body string) {
+	m, r, ok := stream.GetStream(key)
+	assert.True(t, ok)
+	if !ok {
+		return
+	}
+	defer r.Close()
+	assert.Equal(t, metadata, string(m))
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(b))
+}
+
+// countFiles returns the number of files in the directory of a disk cache.
+func countFiles(t *testing.T, dir string) int {
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	return n
+}
@@ -34,42 +34,258 @@ const (
 	FreshnesTransparent
 )
 
-// freshnessFromMaxAge returns the freshness of the response based on the max-age value.
-// https://developer.mozilla.org/en-US/docs/Web/HTTP/Caching#fresh_and_stale_based_on_age
-func freshnessFromMaxAge(maxAge int, responseDated time.Time, clock Clock) Freshness {
-	if maxAge <= 0 {
+// freshnessFromLifetime returns the freshness of a response with the given freshness lifetime and current age.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.2
+func freshnessFromLifetime(lifetime time.Duration, age time.Duration) Freshness {
+	if lifetime > age {
+		return FreshnessFresh
+	}
+	return FreshnessStale
+}
+
+// currentAge returns how long ago the stored response was generated by the origin,
+// as defined by the age calculation of RFC 9111.
+// When the exchange times were not recorded, the response is assumed to be received at its Date.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.2.3
+func currentAge(header http.Header, clock Clock) time.Duration {
+	now := clock.Now()
+
+	dateValue, dateErr := dateFromHeader(header)
+	responseTime, err := responseTimeFromHeader(header)
+	if err != nil {
+		responseTime = now
+		if dateErr == nil {
+			responseTime = dateValue
+		}
+	}
+	requestTime, err := requestTimeFromHeader(header)
+	if err != nil {
+		requestTime = responseTime
+	}
+	if dateErr != nil {
+		dateValue = responseTime
+	}
+
+	var ageValue time.Duration
+	if age, err := ageFromHeader(header); err == nil {
+		ageValue = time.Duration(age) * time.Second
+	}
+
+	apparentAge := max(0, responseTime.Sub(dateValue))
+	responseDelay := responseTime.Sub(requestTime)
+	correctedAgeValue := ageValue + responseDelay
+	correctedInitialAge := max(apparentAge, correctedAgeValue)
+	residentTime := now.Sub(responseTime)
+	return correctedInitialAge + residentTime
+}
+
+// heuristicallyCacheableStatusCodes are the status codes whose responses can be reused
+// with a heuristic freshness lifetime.
+// https://www.rfc-editor.org/rfc/rfc9110#section-15.1
+var heuristicallyCacheableStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusPartialContent:       true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// heuristicWarningAge is the age after which a response served with a heuristic
+// freshness lifetime carries a warning.
+// https://www.rfc-editor.org/rfc/rfc7234#section-4.2.2
+const heuristicWarningAge = 24 * time.Hour
+
+// freshnessPolicy holds the settings of the freshness checks.
+type freshnessPolicy struct {
+	// heuristicFraction is the fraction of the time since the last modification
+	// used as freshness lifetime of responses without explicit expiration.
+	heuristicFraction float64
+	// maxHeuristicLifetime caps the heuristic freshness lifetime.
+	maxHeuristicLifetime time.Duration
+	// shared is set when the cache is shared between users, and applies the
+	// directives that only target shared caches.
+	shared bool
+	// staleIfError is how long past its expiration a response can be served when the origin fails,
+	// if neither the request nor the response has a stale-if-error directive.
+	staleIfError time.Duration
+}
+
+func defaultFreshnessPolicy() freshnessPolicy {
+	return freshnessPolicy{
+		heuristicFraction:    0.1,
+		maxHeuristicLifetime: 24 * time.Hour,
+	}
+}
+
+// canUseHeuristicFreshness reports whether the response can be reused with a heuristic freshness lifetime.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.2.2
+func canUseHeuristicFreshness(statusCode int, header http.Header, cacheControlHeader CacheControl) bool {
+	if _, err := lastModifiedFromHeader(header); err != nil {
+		return false
+	}
+	return heuristicallyCacheableStatusCodes[statusCode] || cacheControlHeader.Public()
+}
+
+// hasExplicitExpiration reports whether the response carries its own freshness lifetime.
+func (p freshnessPolicy) hasExplicitExpiration(header http.Header, cacheControlHeader CacheControl) bool {
+	_, ok := p.freshnessLifetime(header, cacheControlHeader)
+	return ok
+}
+
+// lifetime returns the freshness lifetime of a response, explicit or else heuristic.
+func (p freshnessPolicy) lifetime(header http.Header, cacheControlHeader CacheControl) (time.Duration, bool) {
+	if lifetime, ok := p.freshnessLifetime(header, cacheControlHeader); ok {
+		return lifetime, true
+	}
+	return heuristicLifetime(header, p)
+}
+
+// canServeStale reports whether the stored response may be reused once stale, when the client allows it.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.2.4
+func (p freshnessPolicy) canServeStale(header http.Header, cacheControlHeader CacheControl) bool {
+	return !cacheControlHeader.NoCache() && !p.mustRevalidate(cacheControlHeader) && !p.noCacheEquivalent(header, cacheControlHeader)
+}
+
+// requestedFreshness applies the Cache-Control directives of the request to the freshness of a stored response.
+// The client can ask for a response younger than max-age or fresh for at least min-fresh more seconds,
+// accept a response that is stale by at most max-stale seconds, or force a validation with no-cache.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1
+func (p freshnessPolicy) requestedFreshness(freshness Freshness, header http.Header, cacheControlHeader CacheControl, requestCacheControl CacheControl, clock Clock) Freshness {
+	if freshness == FreshnesTransparent {
+		return freshness
+	}
+	if requestCacheControl.NoCache() {
 		return FreshnessStale
 	}
 
-	if responseDated.IsZero() {
+	lifetime, _ := p.lifetime(header, cacheControlHeader)
+	age := currentAge(header, clock)
+
+	if maxAge, err := requestCacheControl.MaxAge(); err == nil && age > time.Duration(maxAge)*time.Second {
 		return FreshnessStale
 	}
-	if clock.Now().After(responseDated.Add(time.Duration(maxAge) * time.Second)) {
+	if minFresh, err := requestCacheControl.MinFresh(); err == nil && lifetime-age < time.Duration(minFresh)*time.Second {
 		return FreshnessStale
 	}
-	return FreshnessFresh
+
+	if freshness == FreshnessStale && p.canServeStale(header, cacheControlHeader) {
+		if maxStale, err := requestCacheControl.MaxStale(); err == nil && age-lifetime <= time.Duration(maxStale)*time.Second {
+			return FreshnessFresh
+		}
+	}
+	return freshness
 }
 
-// freshnessFromExpire returns the freshness of the response based on the expire value.
-// https://developer.mozilla.org/en-US/docs/Web/HTTP/Caching#expires_or_max-age
-func freshnessFromExpire(expireTime time.Time, responseDated time.Time) Freshness {
-	if expireTime.IsZero() {
-		return FreshnesTransparent
+// canRevalidateInBackground reports whether the stale response can be served while it is revalidated,
+// because it is stale by no more than its stale-while-revalidate window.
+// A client asking for a fresher response, or for a validation, is not served a stale response.
+// https://www.rfc-editor.org/rfc/rfc5861#section-3
+func (p freshnessPolicy) canRevalidateInBackground(header http.Header, cacheControlHeader CacheControl, requestCacheControl CacheControl, clock Clock) bool {
+	if !p.canServeStale(header, cacheControlHeader) || requestCacheControl.NoCache() {
+		return false
 	}
-	if expireTime.Before(responseDated) {
-		return FreshnessStale
+	if _, err := requestCacheControl.MaxAge(); err == nil {
+		return false
+	}
+	if _, err := requestCacheControl.MinFresh(); err == nil {
+		return false
 	}
-	return FreshnessFresh
+
+	staleWhileRevalidate, err := cacheControlHeader.StaleWhileRevalidate()
+	if err != nil {
+		return false
+	}
+	lifetime, _ := p.lifetime(header, cacheControlHeader)
+	return currentAge(header, clock)-lifetime <= time.Duration(staleWhileRevalidate)*time.Second
 }
 
-// freshnessFromAge returns the freshness of the response based on the age value.
-// https://developer.mozilla.org/en-US/docs/Web/HTTP/Caching#fresh_and_stale_based_on_age
-func freshnessFromAge(age int, maxAge int) Freshness {
-	// 150 - 100
-	if maxAge-age > 0 {
-		return FreshnessFresh
+// canServeStaleIfError reports whether the stale response can be served in place of an error of the origin.
+// The window is taken from the stale-if-error request directive, or else from the response directive,
+// or else from the default of the policy.
+// must-revalidate and proxy-revalidate forbid it, whether the cache is shared or not.
+// https://www.rfc-editor.org/rfc/rfc5861#section-4
+func (p freshnessPolicy) canServeStaleIfError(header http.Header, cacheControlHeader CacheControl, requestCacheControl CacheControl, clock Clock) bool {
+	if !p.canServeStale(header, cacheControlHeader) || cacheControlHeader.ProxyRevalidate() {
+		return false
 	}
-	return FreshnessStale
+
+	window := p.staleIfError
+	if staleIfError, err := cacheControlHeader.StaleIfError(); err == nil {
+		window = time.Duration(staleIfError) * time.Second
+	}
+	if staleIfError, err := requestCacheControl.StaleIfError(); err == nil {
+		window = time.Duration(staleIfError) * time.Second
+	}
+	if window <= 0 {
+		return false
+	}
+
+	lifetime, _ := p.lifetime(header, cacheControlHeader)
+	return currentAge(header, clock)-lifetime <= window
+}
+
+// staleLifetime returns how long past its freshness lifetime the response can be served, within its
+// stale-while-revalidate window or its stale-if-error one. It is zero when the response is never served stale.
+// https://www.rfc-editor.org/rfc/rfc5861
+func (p freshnessPolicy) staleLifetime(header http.Header, cacheControlHeader CacheControl) time.Duration {
+	if !p.canServeStale(header, cacheControlHeader) {
+		return 0
+	}
+
+	var window time.Duration
+	if staleWhileRevalidate, err := cacheControlHeader.StaleWhileRevalidate(); err == nil {
+		window = time.Duration(staleWhileRevalidate) * time.Second
+	}
+	if cacheControlHeader.ProxyRevalidate() {
+		return window
+	}
+	staleIfError := p.staleIfError
+	if v, err := cacheControlHeader.StaleIfError(); err == nil {
+		staleIfError = time.Duration(v) * time.Second
+	}
+	return max(window, staleIfError)
+}
+
+// isServerError reports whether the status code is an error that stale-if-error applies to.
+// https://www.rfc-editor.org/rfc/rfc5861#section-4
+func isServerError(statusCode int) bool {
+	switch statusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// mustRevalidate reports whether a stale response must be validated before it is reused,
+// whatever the client accepts.
+// In a shared cache, s-maxage implies proxy-revalidate.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.8
+func (p freshnessPolicy) mustRevalidate(cacheControlHeader CacheControl) bool {
+	if cacheControlHeader.MustRevalidate() {
+		return true
+	}
+	if !p.shared {
+		return false
+	}
+	if _, err := cacheControlHeader.SMaxAge(); err == nil {
+		return true
+	}
+	return cacheControlHeader.ProxyRevalidate()
+}
+
+// noCacheEquivalent reports whether the response must be validated before every reuse,
+// like a response with no-cache.
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Caching#force_revalidation
+func (p freshnessPolicy) noCacheEquivalent(header http.Header, cacheControlHeader CacheControl) bool {
+	lifetime, ok := p.freshnessLifetime(header, cacheControlHeader)
+	return ok && lifetime <= 0 && p.mustRevalidate(cacheControlHeader)
 }
 
 type freshnessChecker interface {
@@ -78,24 +294,54 @@ type freshnessChecker interface {
 
 // Steps to check the freshness of a response:
 // 1. check if the response is cachable
-// 2. check if the response is fresh based on age and max-age
-// 3. check if the response is fresh based on max-age
-// 4. check if the response is fresh based on expires
-// 5. if none of the above, the response is stale
-func newFreshnerChecker(clock Clock) freshnessChecker {
+// 2. check if the response is fresh based on its current age and max-age
+// 3. check if the response is fresh based on its current age and expires
+// 4. check if the response is fresh based on its current age and a heuristic lifetime
+// 5. if none of the above, the response is not cacheable
+func newFreshnerChecker(clock Clock, policy freshnessPolicy) freshnessChecker {
 	return noCacheFreshness{
-		ageFreshnessChecker{
-			maxAgeFreshnessChecker{
+		policy: policy,
+		next: sMaxAgeFreshnessChecker{
+			next: maxAgeFreshnessChecker{
 				next: expireFreshnessChecker{
-					transparentFreshness{},
+					next: heuristicFreshnessChecker{
+						next:   transparentFreshness{},
+						clock:  clock,
+						policy: policy,
+					},
+					clock: clock,
 				},
 				clock: clock,
 			},
+			clock:  clock,
+			shared: policy.shared,
 		},
 	}
 
 }
 
+type sMaxAgeFreshnessChecker struct {
+	next   freshnessChecker
+	clock  Clock
+	shared bool
+}
+
+// In a shared cache, s-maxage overrides both max-age and Expires.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.10
+func (c sMaxAgeFreshnessChecker) Freshness(ctx context.Context, header http.Header, cacheControlHeader CacheControl) (Freshness, error) {
+	if !c.shared {
+		return c.next.Freshness(ctx, header, cacheControlHeader)
+	}
+
+	sMaxAge, err := cacheControlHeader.SMaxAge()
+	if err != nil {
+		return c.next.Freshness(ctx, header, cacheControlHeader)
+	}
+
+	age := currentAge(header, c.clock)
+	return freshnessFromLifetime(time.Duration(sMaxAge)*time.Second, age), nil
+}
+
 type maxAgeFreshnessChecker struct {
 	next  freshnessChecker
 	clock Clock
@@ -107,16 +353,13 @@ func (c maxAgeFreshnessChecker) Freshness(ctx context.Context, header http.Heade
 		return c.next.Freshness(ctx, header, cacheControlHeader)
 	}
 
-	date, err := dateFromHeader(header)
-	if err != nil {
-		return c.next.Freshness(ctx, header, cacheControlHeader)
-	}
-
-	return freshnessFromMaxAge(maxAge, date, c.clock), nil
+	age := currentAge(header, c.clock)
+	return freshnessFromLifetime(time.Duration(maxAge)*time.Second, age), nil
 }
 
 type expireFreshnessChecker struct {
-	next freshnessChecker
+	next  freshnessChecker
+	clock Clock
 }
 
 func (c expireFreshnessChecker) Freshness(ctx context.Context, header http.Header, cacheControlHeader CacheControl) (Freshness, error) {
@@ -130,29 +373,55 @@ func (c expireFreshnessChecker) Freshness(ctx context.Context, header http.Heade
 		return c.next.Freshness(ctx, header, cacheControlHeader)
 	}
 
-	return freshnessFromExpire(expires, date), nil
+	age := currentAge(header, c.clock)
+	return freshnessFromLifetime(expires.Sub(date), age), nil
 }
 
-type ageFreshnessChecker struct {
-	next freshnessChecker
+type heuristicFreshnessChecker struct {
+	next   freshnessChecker
+	clock  Clock
+	policy freshnessPolicy
 }
 
-func (c ageFreshnessChecker) Freshness(ctx context.Context, header http.Header, cacheControlHeader CacheControl) (Freshness, error) {
-	maxAge, err := cacheControlHeader.MaxAge()
-	if err != nil {
+// Responses without explicit expiration get a freshness lifetime that is a fraction of the
+// time elapsed since their last modification.
+// The status code is not known here, responses whose status code does not allow heuristic
+// freshness are not stored in the first place.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.2.2
+func (c heuristicFreshnessChecker) Freshness(ctx context.Context, header http.Header, cacheControlHeader CacheControl) (Freshness, error) {
+	lifetime, ok := heuristicLifetime(header, c.policy)
+	if !ok {
 		return c.next.Freshness(ctx, header, cacheControlHeader)
 	}
 
-	age, err := ageFromHeader(header)
+	age := currentAge(header, c.clock)
+	return freshnessFromLifetime(lifetime, age), nil
+}
+
+// heuristicLifetime returns the heuristic freshness lifetime of a response with a Last-Modified date.
+func heuristicLifetime(header http.Header, policy freshnessPolicy) (time.Duration, bool) {
+	lastModified, err := lastModifiedFromHeader(header)
 	if err != nil {
-		return c.next.Freshness(ctx, header, cacheControlHeader)
+		return 0, false
+	}
+
+	date, err := dateFromHeader(header)
+	if err != nil {
+		if date, err = responseTimeFromHeader(header); err != nil {
+			return 0, false
+		}
 	}
 
-	return freshnessFromAge(age, maxAge), nil
+	lifetime := time.Duration(float64(date.Sub(lastModified)) * policy.heuristicFraction)
+	if policy.maxHeuristicLifetime > 0 && lifetime > policy.maxHeuristicLifetime {
+		lifetime = policy.maxHeuristicLifetime
+	}
+	return max(0, lifetime), true
 }
 
 type noCacheFreshness struct {
-	next freshnessChecker
+	next   freshnessChecker
+	policy freshnessPolicy
 }
 
 // https://developer.mozilla.org/en-US/docs/Web/HTTP/Caching#force_revalidation
@@ -167,7 +436,7 @@ func (c noCacheFreshness) Freshness(ctx context.Context, header http.Header, cac
 		return FreshnessStale, nil
 	}
 
-	if cacheControlHeader.NoCacheEquivalent() {
+	if c.policy.noCacheEquivalent(header, cacheControlHeader) {
 		return FreshnessStale, nil
 	}
 
@@ -179,3 +448,56 @@ type transparentFreshness struct{}
 func (c transparentFreshness) Freshness(ctx context.Context, header http.Header, cacheControlHeader CacheControl) (Freshness, error) {
 	return FreshnesTransparent, nil
 }
+
+// freshnessLifetime returns the explicit freshness lifetime of a response,
+// taken from s-maxage in a shared cache, then from max-age, or else from the difference between Expires and Date.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.2.1
+func (p freshnessPolicy) freshnessLifetime(header http.Header, cacheControlHeader CacheControl) (time.Duration, bool) {
+	if p.shared {
+		if sMaxAge, err := cacheControlHeader.SMaxAge(); err == nil {
+			return time.Duration(sMaxAge) * time.Second, true
+		}
+	}
+	if maxAge, err := cacheControlHeader.MaxAge(); err == nil {
+		return time.Duration(maxAge) * time.Second, true
+	}
+
+	expires, err := expiresFromHeader(header)
+	if err != nil {
+		return 0, false
+	}
+	date, err := dateFromHeader(header)
+	if err != nil {
+		return 0, false
+	}
+	return expires.Sub(date), true
+}
+
+// remainingFreshness returns how long the response stays fresh from now on.
+// The lifetime recorded by the transport that stored the response is used, otherwise the second return
+// value is false when the response has no explicit expiration.
+func remainingFreshness(header http.Header, clock Clock) (time.Duration, bool) {
+	lifetime, err := lifetimeFromHeader(header)
+	if err != nil {
+		var ok bool
+		if lifetime, ok = defaultFreshnessPolicy().freshnessLifetime(header, newCacheControl(header)); !ok {
+			return 0, false
+		}
+	}
+	return lifetime - currentAge(header, clock), true
+}
+
+// remainingLifetime returns how long the response can be served from now on, fresh or stale.
+// The stale lifetime recorded by the transport that stored the response is used, the second return value
+// is false when the response has no explicit expiration.
+func remainingLifetime(header http.Header, clock Clock) (time.Duration, bool) {
+	remaining, ok := remainingFreshness(header, clock)
+	if !ok {
+		return 0, false
+	}
+	staleLifetime, err := staleLifetimeFromHeader(header)
+	if err != nil {
+		staleLifetime = defaultFreshnessPolicy().staleLifetime(header, newCacheControl(header))
+	}
+	return remaining + staleLifetime, true
+}
@@ -9,36 +9,72 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestFreshnessFromMaxAge(t *testing.T) {
+func TestFreshnessFromLifetime(t *testing.T) {
+	assert.Equal(t, FreshnessStale, freshnessFromLifetime(100*time.Second, 100*time.Second))
+	assert.Equal(t, FreshnessFresh, freshnessFromLifetime(100*time.Second, 10*time.Second))
+	assert.Equal(t, FreshnessStale, freshnessFromLifetime(100*time.Second, 120*time.Second))
+	assert.Equal(t, FreshnessStale, freshnessFromLifetime(-5*time.Minute, 0))
+}
 
-	ageInSeconds := 100
-	responseDated := time.Now().Add(-3 * time.Minute)
-	assert.Equal(t, FreshnessStale, freshnessFromMaxAge(ageInSeconds, responseDated, NewClock()))
+func TestCurrentAge(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
 
-	ageInSeconds = 100
-	responseDated = time.Now().Add(-2 * time.Minute)
-	assert.Equal(t, FreshnessStale, freshnessFromMaxAge(ageInSeconds, responseDated, NewClock()))
+	// without recorded exchange times, the response is received at its Date
+	headers := make(http.Header)
+	headers.Set("Date", clock.Now().Add(-1*time.Minute).Format(http.TimeFormat))
+	assert.Equal(t, time.Minute, currentAge(headers, clock))
 
-	ageInSeconds = 100
-	responseDated = time.Now().Add(-1 * time.Minute)
-	assert.Equal(t, FreshnessFresh, freshnessFromMaxAge(ageInSeconds, responseDated, NewClock()))
+	headers.Set("Age", "30")
+	assert.Equal(t, 90*time.Second, currentAge(headers, clock))
 
-	ageInSeconds = 0
-	responseDated = time.Now().Add(-1 * time.Minute)
-	assert.Equal(t, FreshnessStale, freshnessFromMaxAge(ageInSeconds, responseDated, NewClock()))
-}
+	// apparent_age dominates when the origin clock is behind
+	requestTime := clock.Now().Add(-2 * time.Minute)
+	responseTime := requestTime.Add(2 * time.Second)
+	headers = withExchangeTimeHeaders(make(http.Header), requestTime, responseTime)
+	headers.Set("Date", responseTime.Add(-10*time.Second).Format(http.TimeFormat))
+	headers.Set("Age", "5")
+	assert.Equal(t, 10*time.Second+2*time.Minute-2*time.Second, currentAge(headers, clock))
 
-func TestFreshnessFromAge(t *testing.T) {
-	assert.Equal(t, FreshnessStale, freshnessFromAge(100, 100))
-	assert.Equal(t, FreshnessFresh, freshnessFromAge(10, 100))
-	assert.Equal(t, FreshnessStale, freshnessFromAge(120, 100))
+	// corrected_age_value dominates when the response was delayed
+	headers.Set("Age", "60")
+	assert.Equal(t, 62*time.Second+2*time.Minute-2*time.Second, currentAge(headers, clock))
 
+	// a response without Date is dated when it was received
+	headers.Del("Date")
+	headers.Del("Age")
+	assert.Equal(t, 2*time.Minute, currentAge(headers, clock))
 }
 
-func TestFreshnessFromExpire(t *testing.T) {
-	assert.Equal(t, FreshnessStale, freshnessFromExpire(time.Now(), time.Now().Add(5*time.Minute)))
-	assert.Equal(t, FreshnessFresh, freshnessFromExpire(time.Now(), time.Now().Add(-5*time.Minute)))
-	assert.Equal(t, FreshnesTransparent, freshnessFromExpire(time.Time{}, time.Now().Add(-5*time.Minute)))
+func TestFreshnessUsesCurrentAge(t *testing.T) {
+	ctx := context.Background()
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	checker := newFreshnerChecker(clock, defaultFreshnessPolicy())
+
+	headers := withExchangeTimeHeaders(make(http.Header), clock.Now(), clock.Now())
+	headers.Set("Cache-Control", "max-age=60")
+	headers.Set("Date", clock.Now().Format(http.TimeFormat))
+	headers.Set("Age", "50")
+	freshness, err := checker.Freshness(ctx, headers, newCacheControl(headers))
+	assert.NoError(t, err)
+	assert.Equal(t, FreshnessFresh, freshness)
+
+	clock.Advance(10 * time.Second)
+	freshness, err = checker.Freshness(ctx, headers, newCacheControl(headers))
+	assert.NoError(t, err)
+	assert.Equal(t, FreshnessStale, freshness)
+
+	headers = withExchangeTimeHeaders(make(http.Header), clock.Now(), clock.Now())
+	headers.Set("Date", clock.Now().Format(http.TimeFormat))
+	headers.Set("Expires", clock.Now().Add(time.Minute).Format(http.TimeFormat))
+	freshness, err = checker.Freshness(ctx, headers, newCacheControl(headers))
+	assert.NoError(t, err)
+	assert.Equal(t, FreshnessFresh, freshness)
+
+	// an Expires in the past of the cache clock is stale, whatever the Date
+	clock.Advance(2 * time.Minute)
+	freshness, err = checker.Freshness(ctx, headers, newCacheControl(headers))
+	assert.NoError(t, err)
+	assert.Equal(t, FreshnessStale, freshness)
 }
 
 func TestFreshness(t *testing.T) {
@@ -47,7 +83,7 @@ func TestFreshness(t *testing.T) {
 	headers.Add("Cache-Control", "max-age=120")
 	headers.Add("Date", time.Now().Add(-1*time.Minute).Format(time.RFC850))
 	cacheControl := newCacheControl(headers)
-	checker := newFreshnerChecker(NewClock())
+	checker := newFreshnerChecker(NewClock(), defaultFreshnessPolicy())
 	freshness, err := checker.Freshness(ctx, headers, cacheControl)
 	assert.NoError(t, err)
 	assert.Equal(t, FreshnessFresh, freshness)
@@ -56,7 +92,7 @@ func TestFreshness(t *testing.T) {
 	headers.Add("Cache-Control", "max-age=40")
 	headers.Add("Date", time.Now().Add(-1*time.Minute).Format(time.RFC850))
 	cacheControl = newCacheControl(headers)
-	checker = newFreshnerChecker(NewClock())
+	checker = newFreshnerChecker(NewClock(), defaultFreshnessPolicy())
 	freshness, err = checker.Freshness(ctx, headers, cacheControl)
 	assert.NoError(t, err)
 	assert.Equal(t, FreshnessStale, freshness)
@@ -64,7 +100,7 @@ func TestFreshness(t *testing.T) {
 	headers = make(http.Header)
 	headers.Add("Date", time.Now().Add(-1*time.Minute).Format(time.RFC850))
 	cacheControl = newCacheControl(headers)
-	checker = newFreshnerChecker(NewClock())
+	checker = newFreshnerChecker(NewClock(), defaultFreshnessPolicy())
 	freshness, err = checker.Freshness(ctx, headers, cacheControl)
 	assert.NoError(t, err)
 	assert.Equal(t, FreshnesTransparent, freshness)
@@ -73,7 +109,7 @@ func TestFreshness(t *testing.T) {
 	headers.Add("Date", time.Now().Add(-1*time.Minute).Format(time.RFC850))
 	headers.Add("Cache-Control", "max-age=1000, no-cache")
 	cacheControl = newCacheControl(headers)
-	checker = newFreshnerChecker(NewClock())
+	checker = newFreshnerChecker(NewClock(), defaultFreshnessPolicy())
 	freshness, err = checker.Freshness(ctx, headers, cacheControl)
 	assert.NoError(t, err)
 	assert.Equal(t, FreshnessStale, freshness)
@@ -82,7 +118,7 @@ func TestFreshness(t *testing.T) {
 	headers.Add("Date", time.Now().Add(-1*time.Minute).Format(time.RFC850))
 	headers.Add("Cache-Control", "max-age=0, must-revalidate")
 	cacheControl = newCacheControl(headers)
-	checker = newFreshnerChecker(NewClock())
+	checker = newFreshnerChecker(NewClock(), defaultFreshnessPolicy())
 	freshness, err = checker.Freshness(ctx, headers, cacheControl)
 	assert.NoError(t, err)
 	assert.Equal(t, FreshnessStale, freshness)
@@ -91,9 +127,209 @@ func TestFreshness(t *testing.T) {
 	headers.Add("Date", time.Now().Add(-1*time.Minute).Format(time.RFC850))
 	headers.Add("Cache-Control", "max-age=100, must-revalidate")
 	cacheControl = newCacheControl(headers)
-	checker = newFreshnerChecker(NewClock())
+	checker = newFreshnerChecker(NewClock(), defaultFreshnessPolicy())
 	freshness, err = checker.Freshness(ctx, headers, cacheControl)
 	assert.NoError(t, err)
 	assert.Equal(t, FreshnessFresh, freshness)
 
 }
+
+func TestRemainingFreshness(t *testing.T) {
+	headers := make(http.Header)
+	headers.Add("Cache-Control", "max-age=120")
+	headers.Add("Date", time.Now().Add(-1*time.Minute).Format(http.TimeFormat))
+	remaining, ok := remainingFreshness(headers, NewClock())
+	assert.True(t, ok)
+	assert.InDelta(t, 60, remaining.Seconds(), 1)
+
+	headers = make(http.Header)
+	headers.Add("Date", time.Now().Format(http.TimeFormat))
+	headers.Add("Expires", time.Now().Add(time.Minute).Format(http.TimeFormat))
+	headers.Add("Age", "30")
+	remaining, ok = remainingFreshness(headers, NewClock())
+	assert.True(t, ok)
+	assert.InDelta(t, 30, remaining.Seconds(), 1)
+
+	headers = make(http.Header)
+	headers.Add("Date", time.Now().Format(http.TimeFormat))
+	_, ok = remainingFreshness(headers, NewClock())
+	assert.False(t, ok)
+
+	// the lifetime recorded by the transport takes precedence
+	headers = withLifetimeHeader(headers, 10*time.Minute)
+	headers.Add("Cache-Control", "max-age=10")
+	remaining, ok = remainingFreshness(headers, NewClock())
+	assert.True(t, ok)
+	assert.InDelta(t, 600, remaining.Seconds(), 1)
+}
+
+type mockClock struct {
+	now time.Time
+}
+
+func (c *mockClock) Now() time.Time {
+	return c.now
+}
+
+func (c *mockClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestHeuristicFreshness(t *testing.T) {
+	ctx := context.Background()
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	checker := newFreshnerChecker(clock, defaultFreshnessPolicy())
+
+	headers := make(http.Header)
+	headers.Set("Date", clock.Now().Format(http.TimeFormat))
+	headers.Set("Last-Modified", clock.Now().Add(-10*time.Hour).Format(http.TimeFormat))
+	lifetime, ok := heuristicLifetime(headers, defaultFreshnessPolicy())
+	assert.True(t, ok)
+	assert.Equal(t, time.Hour, lifetime)
+
+	freshness, err := checker.Freshness(ctx, headers, newCacheControl(headers))
+	assert.NoError(t, err)
+	assert.Equal(t, FreshnessFresh, freshness)
+
+	clock.Advance(time.Hour)
+	freshness, err = checker.Freshness(ctx, headers, newCacheControl(headers))
+	assert.NoError(t, err)
+	assert.Equal(t, FreshnessStale, freshness)
+
+	// the heuristic lifetime is capped
+	headers.Set("Last-Modified", clock.Now().Add(-100*24*time.Hour).Format(http.TimeFormat))
+	lifetime, ok = heuristicLifetime(headers, defaultFreshnessPolicy())
+	assert.True(t, ok)
+	assert.Equal(t, 24*time.Hour, lifetime)
+
+	lifetime, ok = heuristicLifetime(headers, freshnessPolicy{heuristicFraction: 0.5, maxHeuristicLifetime: 48 * time.Hour})
+	assert.True(t, ok)
+	assert.Equal(t, 48*time.Hour, lifetime)
+
+	// an explicit expiration always wins over the heuristic
+	headers.Set("Cache-Control", "max-age=0")
+	freshness, err = checker.Freshness(ctx, headers, newCacheControl(headers))
+	assert.NoError(t, err)
+	assert.Equal(t, FreshnessStale, freshness)
+}
+
+func TestCanUseHeuristicFreshness(t *testing.T) {
+	headers := make(http.Header)
+	assert.False(t, canUseHeuristicFreshness(http.StatusOK, headers, newCacheControl(headers)))
+
+	headers.Set("Last-Modified", time.Now().Format(http.TimeFormat))
+	assert.True(t, canUseHeuristicFreshness(http.StatusOK, headers, newCacheControl(headers)))
+	assert.True(t, canUseHeuristicFreshness(http.StatusNotFound, headers, newCacheControl(headers)))
+	assert.False(t, canUseHeuristicFreshness(http.StatusInternalServerError, headers, newCacheControl(headers)))
+
+	headers.Set("Cache-Control", "public")
+	assert.True(t, canUseHeuristicFreshness(http.StatusInternalServerError, headers, newCacheControl(headers)))
+}
+
+func TestSharedFreshness(t *testing.T) {
+	ctx := context.Background()
+	headers := make(http.Header)
+	headers.Add("Cache-Control", "max-age=0, s-maxage=120")
+	headers.Add("Date", time.Now().Add(-1*time.Minute).Format(http.TimeFormat))
+	cacheControl := newCacheControl(headers)
+
+	private := defaultFreshnessPolicy()
+	freshness, err := newFreshnerChecker(NewClock(), private).Freshness(ctx, headers, cacheControl)
+	assert.NoError(t, err)
+	assert.Equal(t, FreshnessStale, freshness)
+
+	shared := defaultFreshnessPolicy()
+	shared.shared = true
+	freshness, err = newFreshnerChecker(NewClock(), shared).Freshness(ctx, headers, cacheControl)
+	assert.NoError(t, err)
+	assert.Equal(t, FreshnessFresh, freshness)
+	assert.True(t, shared.mustRevalidate(cacheControl))
+	assert.False(t, private.mustRevalidate(cacheControl))
+
+	headers = make(http.Header)
+	headers.Add("Cache-Control", "max-age=0, proxy-revalidate")
+	cacheControl = newCacheControl(headers)
+	assert.True(t, shared.noCacheEquivalent(headers, cacheControl))
+	assert.False(t, private.noCacheEquivalent(headers, cacheControl))
+}
+
+func TestRequestedFreshness(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	policy := defaultFreshnessPolicy()
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "max-age=60")
+	headers.Set("Date", clock.Now().Add(-30*time.Second).Format(http.TimeFormat))
+	cc := newCacheControl(headers)
+
+	requested := func(freshness Freshness, directives string) Freshness {
+		requestHeaders := make(http.Header)
+		requestHeaders.Set("Cache-Control", directives)
+		return policy.requestedFreshness(freshness, headers, cc, newCacheControl(requestHeaders), clock)
+	}
+
+	assert.Equal(t, FreshnessFresh, requested(FreshnessFresh, ""))
+	assert.Equal(t, FreshnessStale, requested(FreshnessFresh, "no-cache"))
+	assert.Equal(t, FreshnessStale, requested(FreshnessFresh, "max-age=10"))
+	assert.Equal(t, FreshnessFresh, requested(FreshnessFresh, "max-age=40"))
+	assert.Equal(t, FreshnessStale, requested(FreshnessFresh, "min-fresh=40"))
+	assert.Equal(t, FreshnessFresh, requested(FreshnessFresh, "min-fresh=20"))
+	assert.Equal(t, FreshnesTransparent, requested(FreshnesTransparent, "max-stale"))
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, FreshnessStale, requested(FreshnessStale, ""))
+	assert.Equal(t, FreshnessStale, requested(FreshnessStale, "max-stale=10"))
+	assert.Equal(t, FreshnessFresh, requested(FreshnessStale, "max-stale=30"))
+	assert.Equal(t, FreshnessFresh, requested(FreshnessStale, "max-stale"))
+
+	// must-revalidate forbids serving stale responses
+	headers.Set("Cache-Control", "max-age=60, must-revalidate")
+	cc = newCacheControl(headers)
+	assert.Equal(t, FreshnessStale, requested(FreshnessStale, "max-stale"))
+}
+
+func TestCanRevalidateInBackground(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	policy := defaultFreshnessPolicy()
+	headers := make(http.Header)
+	headers.Set("Date", clock.Now().Add(-90*time.Second).Format(http.TimeFormat))
+
+	canRevalidate := func(directives, requestDirectives string) bool {
+		headers.Set("Cache-Control", directives)
+		requestHeaders := make(http.Header)
+		requestHeaders.Set("Cache-Control", requestDirectives)
+		return policy.canRevalidateInBackground(headers, newCacheControl(headers), newCacheControl(requestHeaders), clock)
+	}
+
+	assert.True(t, canRevalidate("max-age=60, stale-while-revalidate=30", ""))
+	assert.False(t, canRevalidate("max-age=60, stale-while-revalidate=20", ""))
+	assert.False(t, canRevalidate("max-age=60", ""))
+	assert.False(t, canRevalidate("max-age=60, stale-while-revalidate=30, must-revalidate", ""))
+	assert.False(t, canRevalidate("max-age=60, stale-while-revalidate=30", "no-cache"))
+	assert.False(t, canRevalidate("max-age=60, stale-while-revalidate=30", "max-age=120"))
+}
+
+func TestCanServeStaleIfError(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	policy := defaultFreshnessPolicy()
+	headers := make(http.Header)
+	headers.Set("Date", clock.Now().Add(-90*time.Second).Format(http.TimeFormat))
+
+	canServe := func(policy freshnessPolicy, directives, requestDirectives string) bool {
+		headers.Set("Cache-Control", directives)
+		requestHeaders := make(http.Header)
+		requestHeaders.Set("Cache-Control", requestDirectives)
+		return policy.canServeStaleIfError(headers, newCacheControl(headers), newCacheControl(requestHeaders), clock)
+	}
+
+	assert.False(t, canServe(policy, "max-age=60", ""))
+	assert.True(t, canServe(policy, "max-age=60, stale-if-error=30", ""))
+	assert.False(t, canServe(policy, "max-age=60, stale-if-error=20", ""))
+	assert.True(t, canServe(policy, "max-age=60", "stale-if-error=30"))
+	assert.False(t, canServe(policy, "max-age=60, stale-if-error=30", "stale-if-error=10"))
+	assert.False(t, canServe(policy, "max-age=60, stale-if-error=30, must-revalidate", ""))
+	assert.False(t, canServe(policy, "max-age=60, stale-if-error=30, proxy-revalidate", ""))
+
+	policy.staleIfError = time.Minute
+	assert.True(t, canServe(policy, "max-age=60", ""))
+	assert.False(t, canServe(policy, "max-age=60, must-revalidate", ""))
+}
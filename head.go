@@ -0,0 +1,71 @@
+package webcache
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// headFromStoredGet answers a HEAD request from the fresh stored response to a GET of the same URI,
+// without its body.
+// https://www.rfc-editor.org/rfc/rfc9110#section-9.3.2
+func (t *Transport) headFromStoredGet(r *http.Request) (*http.Response, bool) {
+	response, ok := t.cache.Get(getRequest(r))
+	if !ok {
+		return nil, false
+	}
+	fresh, ok := t.serveFresh(r, response)
+	if !ok {
+		response.Body.Close()
+		return nil, false
+	}
+	response = fresh
+	response.Body.Close()
+	response.Body = http.NoBody
+	response.Request = r
+	return response, true
+}
+
+// updateFromHead updates the headers of the stored response to a GET of the same URI with the response
+// to a HEAD request, or removes it when the HEAD response shows that the representation changed.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.3.5
+func (t *Transport) updateFromHead(r *http.Request, head *http.Response, requestTime, responseTime time.Time) {
+	if head.StatusCode != http.StatusOK {
+		return
+	}
+
+	get := getRequest(r)
+	stored, ok := t.cache.Get(get)
+	if !ok {
+		return
+	}
+	if !sameRepresentation(stored.Header, head.Header) {
+		stored.Body.Close()
+		t.cache.Delete(get)
+		return
+	}
+
+	stored.Header = withUpdatedHeaders(stored.Header, head.Header)
+	if !t.shouldStore(get, stored) {
+		stored.Body.Close()
+		t.cache.Delete(get)
+		return
+	}
+	if !t.storeAgain(get, stored, requestTime, responseTime) {
+		// the response is stored again as its body is read
+		_, _ = io.Copy(io.Discard, stored.Body)
+	}
+	stored.Body.Close()
+}
+
+// sameRepresentation reports whether a newer response describes the same representation as the stored
+// response, that is whether the ETag, Last-Modified and Content-Length they both have are equal.
+func sameRepresentation(stored, update http.Header) bool {
+	for _, name := range []string{"ETag", "Last-Modified", "Content-Length"} {
+		v := update.Get(name)
+		if v != "" && stored.Get(name) != "" && stored.Get(name) != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package webcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameRepresentation(t *testing.T) {
+	stored := make(http.Header)
+	stored.Set("ETag", `"a"`)
+	stored.Set("Content-Length", "11")
+
+	update := make(http.Header)
+	assert.True(t, sameRepresentation(stored, update))
+	update.Set("ETag", `"a"`)
+	update.Set("Last-Modified", time.Now().Format(http.TimeFormat))
+	assert.True(t, sameRepresentation(stored, update))
+	update.Set("Content-Length", "12")
+	assert.False(t, sameRepresentation(stored, update))
+	update.Set("Content-Length", "11")
+	update.Set("ETag", `"b"`)
+	assert.False(t, sameRepresentation(stored, update))
+}
+
+// headOrigin answers GET requests with body, and HEAD requests with the header fields of headHeader.
+type headOrigin struct {
+	clock      Clock
+	headHeader http.Header
+	calls      map[string]int
+}
+
+func (o *headOrigin) RoundTrip(r *http.Request) (*http.Response, error) {
+	o.calls[r.Method]++
+	header := make(http.Header)
+	header.Set("Cache-Control", "max-age=60")
+	header.Set("Date", o.clock.Now().Format(http.TimeFormat))
+	header.Set("ETag", `"a"`)
+	header.Set("Content-Length", "4")
+	if r.Method == http.MethodHead {
+		for k, v := range o.headHeader {
+			header[k] = v
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody}, nil
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		ContentLength: 4,
+		Body:          io.NopCloser(bytes.NewReader([]byte("body"))),
+	}, nil
+}
+
+func newHeadTransport(t *testing.T, headHeader http.Header) (*Transport, *headOrigin, *mockClock) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	origin := &headOrigin{clock: clock, headHeader: headHeader, calls: make(map[string]int)}
+	transport := NewTransport(NewCache(), origin, WithClock(clock))
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	return transport, origin, clock
+}
+
+func TestRoundTripHeadFromStoredGet(t *testing.T) {
+	transport, origin, _ := newHeadTransport(t, nil)
+
+	r, err := http.NewRequest(http.MethodHead, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, `"a"`, response.Header.Get("ETag"))
+	assert.Equal(t, "4", response.Header.Get("Content-Length"))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Empty(t, body)
+	assert.Equal(t, 0, origin.calls[http.MethodHead])
+}
+
+func TestRoundTripHeadUpdatesStoredGet(t *testing.T) {
+	headHeader := make(http.Header)
+	headHeader.Set("Cache-Control", "max-age=600")
+	transport, origin, clock := newHeadTransport(t, headHeader)
+	clock.Advance(2 * time.Minute)
+
+	// the stored GET response is stale, the HEAD request reaches the origin and freshens it
+	r, err := http.NewRequest(http.MethodHead, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.False(t, servedFromCache(response))
+	assert.Equal(t, 1, origin.calls[http.MethodHead])
+
+	get, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err = transport.RoundTrip(get)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, "max-age=600", response.Header.Get("Cache-Control"))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+	assert.Equal(t, 1, origin.calls[http.MethodGet])
+}
+
+func TestRoundTripHeadInvalidatesChangedGet(t *testing.T) {
+	headHeader := make(http.Header)
+	headHeader.Set("ETag", `"b"`)
+	transport, origin, _ := newHeadTransport(t, headHeader)
+
+	r, err := http.NewRequest(http.MethodHead, "http://example.com", nil)
+	assert.NoError(t, err)
+	r.Header.Set("Cache-Control", "no-cache")
+	_, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, origin.calls[http.MethodHead])
+
+	get, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, ok := transport.cache.Get(get)
+	assert.False(t, ok)
+}
@@ -2,6 +2,8 @@ package webcache
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,6 +14,21 @@ var (
 	ErrorInvalidMaxAge  = errors.New("invalid max-age")
 	ErrorMaxAgeNotFound = errors.New("max-age not found")
 
+	ErrorInvalidSMaxAge  = errors.New("invalid s-maxage")
+	ErrorSMaxAgeNotFound = errors.New("s-maxage not found")
+
+	ErrorInvalidMaxStale  = errors.New("invalid max-stale")
+	ErrorMaxStaleNotFound = errors.New("max-stale not found")
+
+	ErrorInvalidMinFresh  = errors.New("invalid min-fresh")
+	ErrorMinFreshNotFound = errors.New("min-fresh not found")
+
+	ErrorInvalidStaleWhileRevalidate  = errors.New("invalid stale-while-revalidate")
+	ErrorStaleWhileRevalidateNotFound = errors.New("stale-while-revalidate not found")
+
+	ErrorInvalidStaleIfError  = errors.New("invalid stale-if-error")
+	ErrorStaleIfErrorNotFound = errors.New("stale-if-error not found")
+
 	ErrorInvalidAge  = errors.New("invalid age")
 	ErrorAgeNotFound = errors.New("age not found")
 
@@ -20,19 +37,49 @@ var (
 	ErrorInvalidResponseDate = errors.New("invalid response date")
 	ErrorInvalidExpireDate   = errors.New("invalid expire date")
 	ErrInvalidLastModified   = errors.New("invalid last modified date")
+	ErrorInvalidExchangeTime = errors.New("invalid exchange time")
+)
+
+// Headers recorded on stored responses, they are removed before a response is served.
+const (
+	headerRequestTime  = "X-Webcache-Request-Time"
+	headerResponseTime = "X-Webcache-Response-Time"
+	// headerLifetime is the freshness lifetime of the response in seconds, as computed by the transport
+	// that stored it, which may be a shared cache or use other heuristics than the default ones
+	headerLifetime = "X-Webcache-Lifetime"
+	// headerStaleLifetime is how long in seconds the response can be served stale past its freshness lifetime,
+	// as allowed by the transport that stored it, whose default stale-if-error window is not in the response
+	headerStaleLifetime = "X-Webcache-Stale-Lifetime"
 )
 
+var internalHeaders = []string{headerRequestTime, headerResponseTime, headerLifetime, headerStaleLifetime}
+
 type cacheControlKey string
 
 var (
 	cacheControlKeyMaxAge         = cacheControlKey("max-age")
+	cacheControlKeySMaxAge        = cacheControlKey("s-maxage")
 	cacheControlKeyPublic         = cacheControlKey("public")
 	cacheControlKeyPrivate        = cacheControlKey("private")
 	cacheControlKeyNoCache        = cacheControlKey("no-cache")
 	cacheControlKeyNoStore        = cacheControlKey("no-store")
 	cacheControlKeyMustRevalidate = cacheControlKey("must-revalidate")
+
+	cacheControlKeyProxyRevalidate = cacheControlKey("proxy-revalidate")
+
+	// https://www.rfc-editor.org/rfc/rfc5861
+	cacheControlKeyStaleWhileRevalidate = cacheControlKey("stale-while-revalidate")
+	cacheControlKeyStaleIfError         = cacheControlKey("stale-if-error")
+
+	// request directives
+	cacheControlKeyMaxStale     = cacheControlKey("max-stale")
+	cacheControlKeyMinFresh     = cacheControlKey("min-fresh")
+	cacheControlKeyOnlyIfCached = cacheControlKey("only-if-cached")
 )
 
+// unlimitedMaxStale is the staleness accepted by a max-stale request directive without value.
+const unlimitedMaxStale = math.MaxInt32
+
 type CacheControl map[cacheControlKey]string
 
 func (c CacheControl) MaxAge() (int, error) {
@@ -47,6 +94,95 @@ func (c CacheControl) MaxAge() (int, error) {
 	return maxAge, nil
 }
 
+// SMaxAge returns the max-age that applies to shared caches.
+func (c CacheControl) SMaxAge() (int, error) {
+	v, ok := c[cacheControlKeySMaxAge]
+	if !ok {
+		return 0, ErrorSMaxAgeNotFound
+	}
+	sMaxAge, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, ErrorInvalidSMaxAge
+	}
+	return sMaxAge, nil
+}
+
+// MaxStale returns how many seconds past its expiration the client accepts a stale response.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.2
+func (c CacheControl) MaxStale() (int, error) {
+	v, ok := c[cacheControlKeyMaxStale]
+	if !ok {
+		return 0, ErrorMaxStaleNotFound
+	}
+	// without a value, the client accepts a stale response of any age
+	if v == "" {
+		return unlimitedMaxStale, nil
+	}
+	maxStale, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, ErrorInvalidMaxStale
+	}
+	return maxStale, nil
+}
+
+// MinFresh returns for how many more seconds the client wants the response to stay fresh.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.3
+func (c CacheControl) MinFresh() (int, error) {
+	v, ok := c[cacheControlKeyMinFresh]
+	if !ok {
+		return 0, ErrorMinFreshNotFound
+	}
+	minFresh, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, ErrorInvalidMinFresh
+	}
+	return minFresh, nil
+}
+
+// StaleWhileRevalidate returns for how many seconds past its expiration the response can be served
+// while it is revalidated in the background.
+// https://www.rfc-editor.org/rfc/rfc5861#section-3
+func (c CacheControl) StaleWhileRevalidate() (int, error) {
+	v, ok := c[cacheControlKeyStaleWhileRevalidate]
+	if !ok {
+		return 0, ErrorStaleWhileRevalidateNotFound
+	}
+	staleWhileRevalidate, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, ErrorInvalidStaleWhileRevalidate
+	}
+	return staleWhileRevalidate, nil
+}
+
+// StaleIfError returns for how many seconds past its expiration the response can be served
+// when the origin cannot be reached or fails.
+// It is both a request and a response directive.
+// https://www.rfc-editor.org/rfc/rfc5861#section-4
+func (c CacheControl) StaleIfError() (int, error) {
+	v, ok := c[cacheControlKeyStaleIfError]
+	if !ok {
+		return 0, ErrorStaleIfErrorNotFound
+	}
+	staleIfError, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, ErrorInvalidStaleIfError
+	}
+	return staleIfError, nil
+}
+
+// OnlyIfCached indicates that the client only wants a stored response.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.7
+func (c CacheControl) OnlyIfCached() bool {
+	_, ok := c[cacheControlKeyOnlyIfCached]
+	return ok
+}
+
+// ProxyRevalidate is the must-revalidate directive of shared caches.
+func (c CacheControl) ProxyRevalidate() bool {
+	_, ok := c[cacheControlKeyProxyRevalidate]
+	return ok
+}
+
 func (c CacheControl) MustRevalidate() bool {
 	_, ok := c[cacheControlKeyMustRevalidate]
 	return ok
@@ -57,14 +193,18 @@ func (c CacheControl) Public() bool {
 	return ok
 }
 
+// Private reports the unqualified private directive, a qualified private="field" only restricts
+// the listed fields, see PrivateFields.
 func (c CacheControl) Private() bool {
-	_, ok := c[cacheControlKeyPrivate]
-	return ok
+	v, ok := c[cacheControlKeyPrivate]
+	return ok && v == ""
 }
 
+// NoCache reports the unqualified no-cache directive, a qualified no-cache="field" only restricts
+// the listed fields, see NoCacheFields.
 func (c CacheControl) NoCache() bool {
-	_, ok := c[cacheControlKeyNoCache]
-	return ok
+	v, ok := c[cacheControlKeyNoCache]
+	return ok && v == ""
 }
 
 func (c CacheControl) NoStore() bool {
@@ -89,8 +229,8 @@ func (c CacheControl) NoCacheEquivalent() bool {
 
 func ageFromHeader(h http.Header) (int, error) {
 	age, err := strconv.Atoi(h.Get("Age"))
-	if err != nil {
-		return 0, ErrorInvalidMaxAge
+	if err != nil || age < 0 {
+		return 0, ErrorInvalidAge
 	}
 	return age, nil
 }
@@ -127,6 +267,42 @@ func timeFromHeader(h http.Header, key string) (time.Time, error) {
 	return v, nil
 }
 
+// requestTimeFromHeader returns the time at which the stored response was requested from the origin.
+func requestTimeFromHeader(h http.Header) (time.Time, error) {
+	return unixTimeFromHeader(h, headerRequestTime)
+}
+
+// responseTimeFromHeader returns the time at which the stored response was received from the origin.
+func responseTimeFromHeader(h http.Header) (time.Time, error) {
+	return unixTimeFromHeader(h, headerResponseTime)
+}
+
+// lifetimeFromHeader returns the freshness lifetime recorded on the stored response.
+func lifetimeFromHeader(h http.Header) (time.Duration, error) {
+	v, err := strconv.ParseInt(h.Get(headerLifetime), 10, 64)
+	if err != nil {
+		return 0, ErrorInvalidExchangeTime
+	}
+	return time.Duration(v) * time.Second, nil
+}
+
+// staleLifetimeFromHeader returns the stale lifetime recorded on the stored response.
+func staleLifetimeFromHeader(h http.Header) (time.Duration, error) {
+	v, err := strconv.ParseInt(h.Get(headerStaleLifetime), 10, 64)
+	if err != nil {
+		return 0, ErrorInvalidExchangeTime
+	}
+	return time.Duration(v) * time.Second, nil
+}
+
+func unixTimeFromHeader(h http.Header, key string) (time.Time, error) {
+	v, err := strconv.ParseInt(h.Get(key), 10, 64)
+	if err != nil {
+		return time.Time{}, ErrorInvalidExchangeTime
+	}
+	return time.Unix(0, v), nil
+}
+
 func etagFromHeader(h http.Header) (string, error) {
 	etag := strings.TrimSpace(h.Get("Etag"))
 	if etag == "" {
@@ -153,34 +329,102 @@ func withCacheHitHeader(h http.Header) http.Header {
 	return headers
 }
 
-func newCacheControl(h http.Header) CacheControl {
-	cc := CacheControl{}
-	for k, v := range h {
-		if k != "Cache-Control" {
-			continue
-		}
-		for _, vv := range v {
-			for _, vvv := range splitCacheControl(vv) {
-				kv := splitCacheControlKeyValue(vvv)
-				if len(kv) == 2 {
-					cc[cacheControlKey(kv[0])] = kv[1]
-				}
-				if len(kv) == 1 {
-					cc[cacheControlKey(kv[0])] = ""
-				}
-			}
+func withWarningHeader(h http.Header, code int, text string) http.Header {
+	headers := h.Clone()
+	headers.Add("Warning", fmt.Sprintf("%d - %q", code, text))
+	return headers
+}
+
+func withAgeHeader(h http.Header, age time.Duration) http.Header {
+	headers := h.Clone()
+	headers.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	return headers
+}
+
+// withExchangeTimeHeaders records when the response was requested and received,
+// so that its age can be computed once it is stored.
+func withExchangeTimeHeaders(h http.Header, requestTime, responseTime time.Time) http.Header {
+	headers := h.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set(headerRequestTime, strconv.FormatInt(requestTime.UnixNano(), 10))
+	headers.Set(headerResponseTime, strconv.FormatInt(responseTime.UnixNano(), 10))
+	return headers
+}
+
+// withLifetimeHeader records the freshness lifetime of the response, so that the expiry of stored entries
+// follows the policy of the transport that stored it.
+func withLifetimeHeader(h http.Header, lifetime time.Duration) http.Header {
+	headers := h.Clone()
+	headers.Set(headerLifetime, strconv.FormatInt(int64(lifetime/time.Second), 10))
+	return headers
+}
+
+// withStaleLifetimeHeader records how long the response can be served stale, so that stored entries are kept
+// as long as they can be served.
+func withStaleLifetimeHeader(h http.Header, staleLifetime time.Duration) http.Header {
+	headers := h.Clone()
+	headers.Set(headerStaleLifetime, strconv.FormatInt(int64(staleLifetime/time.Second), 10))
+	return headers
+}
+
+// notUpdatedHeaders are the fields of a stored response that are kept when it is updated with the
+// header fields of a newer response, such as a 304 or a HEAD response.
+// https://www.rfc-editor.org/rfc/rfc9111#section-3.2
+var notUpdatedHeaders = []string{
+	"Content-Length",
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// withUpdatedHeaders replaces the fields of the stored header with the fields of the update,
+// except for the fields that describe the stored body or the connection.
+func withUpdatedHeaders(stored, update http.Header) http.Header {
+	headers := stored.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	for k, v := range update {
+		headers[k] = append([]string(nil), v...)
+	}
+	for _, k := range notUpdatedHeaders {
+		if v, ok := stored[k]; ok {
+			headers[k] = v
+		} else {
+			delete(headers, k)
 		}
 	}
-	return cc
+	return headers
 }
 
-func (c CacheControl) IsPresent() bool {
-	return len(c) > 0
+func withoutHeaders(h http.Header, names []string) http.Header {
+	headers := h.Clone()
+	for _, k := range names {
+		headers.Del(k)
+	}
+	return headers
+}
+
+func withoutInternalHeaders(h http.Header) http.Header {
+	headers := h.Clone()
+	for _, k := range internalHeaders {
+		headers.Del(k)
+	}
+	return headers
 }
-func splitCacheControl(s string) []string {
-	return strings.Split(strings.TrimSpace(s), ",")
+
+// newCacheControl returns the directives of the Cache-Control header, ignoring the invalid ones.
+func newCacheControl(h http.Header) CacheControl {
+	cc, _ := ParseCacheControl(h)
+	return cc
 }
 
-func splitCacheControlKeyValue(s string) []string {
-	return strings.Split(strings.TrimSpace(s), "=")
+func (c CacheControl) IsPresent() bool {
+	return len(c) > 0
 }
@@ -141,3 +141,102 @@ func TestCacheControlPresent(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, newCacheControl(r.Header).IsPresent())
 }
+
+func TestCacheControlSharedDirectives(t *testing.T) {
+	header := make(http.Header)
+	header.Add("Cache-Control", "max-age=10, s-maxage=100, proxy-revalidate")
+	cc := newCacheControl(header)
+	sMaxAge, err := cc.SMaxAge()
+	assert.NoError(t, err)
+	assert.Equal(t, 100, sMaxAge)
+	assert.True(t, cc.ProxyRevalidate())
+
+	cc = CacheControl{cacheControlKeySMaxAge: "abc"}
+	_, err = cc.SMaxAge()
+	assert.ErrorIs(t, err, ErrorInvalidSMaxAge)
+
+	_, err = CacheControl{}.SMaxAge()
+	assert.ErrorIs(t, err, ErrorSMaxAgeNotFound)
+}
+
+func TestCacheControlRequestDirectives(t *testing.T) {
+	header := make(http.Header)
+	header.Add("Cache-Control", "max-stale=10, min-fresh=20, only-if-cached")
+	cc := newCacheControl(header)
+	maxStale, err := cc.MaxStale()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, maxStale)
+	minFresh, err := cc.MinFresh()
+	assert.NoError(t, err)
+	assert.Equal(t, 20, minFresh)
+	assert.True(t, cc.OnlyIfCached())
+
+	header.Set("Cache-Control", "max-stale")
+	cc = newCacheControl(header)
+	maxStale, err = cc.MaxStale()
+	assert.NoError(t, err)
+	assert.Equal(t, unlimitedMaxStale, maxStale)
+	assert.False(t, cc.OnlyIfCached())
+	_, err = cc.MinFresh()
+	assert.ErrorIs(t, err, ErrorMinFreshNotFound)
+}
+
+func TestCacheControlStaleWhileRevalidate(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+	staleWhileRevalidate, err := newCacheControl(header).StaleWhileRevalidate()
+	assert.NoError(t, err)
+	assert.Equal(t, 30, staleWhileRevalidate)
+
+	header.Set("Cache-Control", "max-age=60")
+	_, err = newCacheControl(header).StaleWhileRevalidate()
+	assert.ErrorIs(t, err, ErrorStaleWhileRevalidateNotFound)
+}
+
+func TestCacheControlStaleIfError(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Cache-Control", "max-age=60, stale-if-error=300")
+	staleIfError, err := newCacheControl(header).StaleIfError()
+	assert.NoError(t, err)
+	assert.Equal(t, 300, staleIfError)
+
+	header.Set("Cache-Control", "stale-if-error=abc")
+	_, err = newCacheControl(header).StaleIfError()
+	assert.ErrorIs(t, err, ErrorInvalidStaleIfError)
+}
+
+func TestWithUpdatedHeaders(t *testing.T) {
+	stored := make(http.Header)
+	stored.Set("Cache-Control", "max-age=60")
+	stored.Set("Content-Length", "11")
+	stored.Set("ETag", `"a"`)
+	stored.Set("X-Stored", "1")
+
+	update := make(http.Header)
+	update.Set("Cache-Control", "max-age=120")
+	update.Set("Content-Length", "0")
+	update.Set("Transfer-Encoding", "chunked")
+	update.Set("X-Updated", "1")
+
+	headers := withUpdatedHeaders(stored, update)
+	assert.Equal(t, "max-age=120", headers.Get("Cache-Control"))
+	assert.Equal(t, "11", headers.Get("Content-Length"))
+	assert.Equal(t, `"a"`, headers.Get("ETag"))
+	assert.Equal(t, "1", headers.Get("X-Stored"))
+	assert.Equal(t, "1", headers.Get("X-Updated"))
+	assert.Empty(t, headers.Get("Transfer-Encoding"))
+	assert.Equal(t, "max-age=60", stored.Get("Cache-Control"))
+}
+
+func TestCacheControlQualifiedDirectives(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Cache-Control", `no-cache="Set-Cookie", private="X-User"`)
+	cc := newCacheControl(header)
+	assert.False(t, cc.NoCache())
+	assert.False(t, cc.Private())
+
+	header.Set("Cache-Control", "no-cache, private")
+	cc = newCacheControl(header)
+	assert.True(t, cc.NoCache())
+	assert.True(t, cc.Private())
+}
@@ -3,8 +3,14 @@ package webcache
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"net/http"
-	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type HTTPCache interface {
@@ -15,40 +21,432 @@ type HTTPCache interface {
 
 type httpCache struct {
 	cache Cache[string, []byte]
+	// stream is the cache itself when it implements StreamingCache, the responses are then stored
+	// as streams and only the variant indexes are stored as values of cache
+	stream StreamingCache
+	// locks serializes the updates of the variant indexes, per primary key
+	locks keyLocks
+	// maxBufferSize bounds the bodies held in memory until they are stored in a cache that does not stream
+	maxBufferSize int
 }
 
-func NewHTTPCache(cache Cache[string, []byte]) HTTPCache {
-	return &httpCache{cache: cache}
+// defaultMaxBufferSize is the largest body held in memory to be stored in a cache that does not stream.
+const defaultMaxBufferSize = 32 << 20
+
+type HTTPCacheOption func(*httpCache)
+
+// WithHTTPCacheMaxBufferSize sets the largest body that is held in memory to be stored in a cache that
+// does not implement StreamingCache, responses with larger bodies are not stored. It defaults to 32MB,
+// zero or less means no limit.
+func WithHTTPCacheMaxBufferSize(n int) HTTPCacheOption {
+	return func(c *httpCache) {
+		c.maxBufferSize = n
+	}
+}
+
+// NewHTTPCache returns an HTTPCache that stores responses in the cache.
+// When the cache implements StreamingCache, the response bodies are streamed to and from it
+// instead of being held in memory.
+func NewHTTPCache(cache Cache[string, []byte], opts ...HTTPCacheOption) HTTPCache {
+	stream, _ := cache.(StreamingCache)
+	c := &httpCache{cache: cache, stream: stream, maxBufferSize: defaultMaxBufferSize}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
 }
 
+// Get returns the stored response selected by the request.
+// When the stored responses vary on request headers, the variant matching the request is returned.
 func (c *httpCache) Get(r *http.Request) (*http.Response, bool) {
-	cacheKey := buildCacheKey(r)
-	if cachedVal, ok := c.cache.Get(cacheKey.String()); ok {
-		b := bytes.NewBuffer(cachedVal)
-		v, err := http.ReadResponse(bufio.NewReader(b), nil)
-		if err != nil {
+	primary := buildCacheKey(r)
+	cachedVal, ok := c.cache.Get(primary.String())
+	if !ok {
+		// a response stored as a stream is not a value of the cache
+		if c.stream != nil {
+			return c.response(primary.String())
+		}
+		return nil, false
+	}
+
+	if idx, ok := decodeVariantIndex(cachedVal); ok {
+		variant, ok := idx.match(r.Header)
+		if !ok {
 			return nil, false
 		}
-		return v, true
+		return c.response(variant.Key)
 	}
-	return nil, false
+	return readStoredResponse(cachedVal)
 }
 
+// response returns the response stored under the key.
+func (c *httpCache) response(key string) (*http.Response, bool) {
+	if c.stream == nil {
+		b, ok := c.cache.Get(key)
+		if !ok {
+			return nil, false
+		}
+		return readStoredResponse(b)
+	}
+
+	metadata, body, ok := c.stream.GetStream(key)
+	if !ok {
+		return nil, false
+	}
+	response, ok := readStoredResponse(metadata)
+	if !ok {
+		body.Close()
+		return nil, false
+	}
+	// the length of a body streamed without Content-Length is only known once it is stored
+	if s, ok := body.(sizedReader); ok && response.ContentLength < 0 {
+		response.ContentLength = s.size()
+		response.Header.Set("Content-Length", strconv.FormatInt(response.ContentLength, 10))
+	}
+	response.Body = body
+	return response, true
+}
+
+// sizedReader is implemented by the readers of StreamingCache values that know the length of the value.
+type sizedReader interface {
+	size() int64
+}
+
+// Set stores the response for the request.
+// The body is not read by Set: it is stored as the caller reads the response, and the response is
+// only stored once its body is read up to EOF, or up to its Content-Length before it is closed.
+// It is not stored when reading the body fails, or when the body is closed before its end.
+// Responses with a Vary header are stored as a variant of the request URL, selected by the
+// request headers named in Vary. Responses with "Vary: *" are never stored.
 func (c *httpCache) Set(r *http.Request, response *http.Response) {
-	b, err := httputil.DumpResponse(response, true)
-	if err != nil {
+	vary := varyFieldNames(response.Header)
+	if varyWildcard(vary) {
 		return
 	}
 
-	cacheKey := buildCacheKey(r)
-	c.cache.Set(cacheKey.String(), b)
+	primary := buildCacheKey(r)
+	var variant *cacheVariant
+	if len(vary) > 0 {
+		v := newCacheVariant(primary, vary, r.Header).withValidators(response.Header)
+		variant = &v
+	}
+
+	body := &cachingBody{body: response.Body, length: response.ContentLength}
+	if c.stream != nil {
+		key := primary.String()
+		if variant != nil {
+			key = variant.Key
+		}
+		w, err := c.stream.PutStream(key, dumpResponseHead(response))
+		if err != nil {
+			return
+		}
+		body.w = w
+		body.commit = func() {
+			c.set(primary, variant, func(string) bool { return w.Commit() == nil })
+		}
+		body.abort = func() { _ = w.Abort() }
+	} else {
+		if c.maxBufferSize > 0 && response.ContentLength > int64(c.maxBufferSize) {
+			return
+		}
+		// the headers are those of the response at the time of Set, the caller may change them afterwards
+		stored := *response
+		stored.Header = response.Header.Clone()
+		buf := &limitedBuffer{limit: c.maxBufferSize}
+		body.w = buf
+		body.commit = func() {
+			b := storedValue(&stored, buf.Bytes())
+			buf.release()
+			c.set(primary, variant, func(key string) bool {
+				c.cache.Set(key, b)
+				return true
+			})
+		}
+		body.abort = buf.release
+	}
+
+	if response.Body == nil || response.Body == http.NoBody {
+		body.done = true
+		body.commit()
+		return
+	}
+	response.Body = body
+}
+
+// set stores a response under the primary key, or as a variant of it, with put.
+// put reports whether the response was stored. A variant is put before the primary key is locked,
+// only the update of the variant index is serialized with the other updates of the key.
+func (c *httpCache) set(primary cacheKey, variant *cacheVariant, put func(key string) bool) {
+	if variant == nil {
+		defer c.locks.lock(primary.String()).Unlock()
+		// the response replaces the variant index, along with the variants it lists
+		idx, _ := c.variantIndex(primary)
+		if put(primary.String()) {
+			c.deleteVariants(idx.Variants)
+		}
+		return
+	}
+
+	if !put(variant.Key) {
+		return
+	}
+	mu := c.locks.lock(primary.String())
+	idx, _ := c.variantIndex(primary)
+	evicted := idx.add(*variant)
+	indexBytes, err := encodeVariantIndex(idx)
+	if err == nil {
+		c.cache.Set(primary.String(), indexBytes)
+	}
+	mu.Unlock()
+	c.deleteVariants(evicted)
 }
 
+// Delete removes the stored response for the request URL, including all of its variants.
 func (c *httpCache) Delete(r *http.Request) {
-	cacheKey := buildCacheKey(r)
-	c.cache.Delete(cacheKey.String())
+	primary := buildCacheKey(r)
+	defer c.locks.lock(primary.String()).Unlock()
+
+	if idx, ok := c.variantIndex(primary); ok {
+		c.deleteVariants(idx.Variants)
+	}
+	c.cache.Delete(primary.String())
+}
+
+// variantLister is implemented by the caches that list the responses stored for a URI in all their variants,
+// without reading them.
+type variantLister interface {
+	variants(r *http.Request) []cacheVariant
+}
+
+// variants returns the variants listed in the variant index of the target URI of the request, whatever the
+// request headers. It returns nil when the response stored for the URI does not vary.
+func (c *httpCache) variants(r *http.Request) []cacheVariant {
+	idx, _ := c.variantIndex(buildCacheKey(r))
+	return idx.Variants
+}
+
+// headerUpdater is implemented by the caches that replace the header of a stored response, without the body
+// being read again from the response.
+type headerUpdater interface {
+	updateHeader(r *http.Request, response *http.Response) bool
 }
 
-func isCached(r *http.Response) bool {
-	return r.Header.Get("X-Cache") == "HIT"
+// updateHeader replaces the header of the response stored for the request with the header of the response.
+// A body stored as a stream is left as is, only the metadata of its entry is rewritten. It reports false when
+// the stored response is not updated, because the response no longer varies the same way, or because the
+// stored response was replaced.
+func (c *httpCache) updateHeader(r *http.Request, response *http.Response) bool {
+	vary := varyFieldNames(response.Header)
+	if varyWildcard(vary) {
+		return false
+	}
+
+	primary := buildCacheKey(r)
+	var variant *cacheVariant
+	if len(vary) > 0 {
+		v := newCacheVariant(primary, vary, r.Header).withValidators(response.Header)
+		variant = &v
+	}
+	updated := false
+	c.set(primary, variant, func(key string) bool {
+		current, ok := c.response(key)
+		if !ok {
+			return false
+		}
+		defer current.Body.Close()
+		if !sameRepresentation(current.Header, response.Header) {
+			return false
+		}
+
+		if c.stream != nil {
+			updated = c.stream.UpdateMetadata(key, dumpResponseHead(response)) == nil
+			return updated
+		}
+		// a value holds the body along with the header, the body is already in memory
+		body, err := io.ReadAll(current.Body)
+		if err != nil {
+			return false
+		}
+		c.cache.Set(key, storedValue(response, body))
+		updated = true
+		return true
+	})
+	return updated
+}
+
+// variantIndexer is implemented by the caches that tell whether responses stored for a URI vary on request
+// header fields, without reading them.
+type variantIndexer interface {
+	hasVariantIndex(r *http.Request) bool
+}
+
+// hasVariantIndex reports whether a variant index is stored for the target URI of the request.
+func (c *httpCache) hasVariantIndex(r *http.Request) bool {
+	_, ok := c.variantIndex(buildCacheKey(r))
+	return ok
+}
+
+func (c *httpCache) variantIndex(primary cacheKey) (variantIndex, bool) {
+	b, ok := c.cache.Get(primary.String())
+	if !ok {
+		return variantIndex{}, false
+	}
+	return decodeVariantIndex(b)
+}
+
+func (c *httpCache) deleteVariants(variants []cacheVariant) {
+	for _, v := range variants {
+		c.cache.Delete(v.Key)
+	}
+}
+
+// keyLocks serializes the updates of the responses stored for the same primary key. The keys are spread
+// over a fixed number of locks, keys that share a lock are serialized as well.
+type keyLocks [64]sync.Mutex
+
+// lock locks the lock of the key, and returns it to be unlocked.
+func (l *keyLocks) lock(key string) *sync.Mutex {
+	mu := &l[l.index(key)]
+	mu.Lock()
+	return mu
+}
+
+func (l *keyLocks) index(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(l)))
+}
+
+// cachingBody is the body of a response being stored: what the caller reads is written to w, and
+// committed to the cache once the body is read up to EOF, or once it is closed after length bytes were
+// read. It is aborted if reading or writing fails, or if the body is closed before its end.
+type cachingBody struct {
+	body   io.ReadCloser
+	w      io.Writer
+	commit func()
+	abort  func()
+	done   bool
+	// length is the Content-Length of the response, -1 when it is unknown
+	length  int64
+	written int64
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if b.done {
+		return n, err
+	}
+	if _, werr := b.w.Write(p[:n]); werr != nil {
+		b.discard()
+		return n, err
+	}
+	b.written += int64(n)
+	if err == io.EOF {
+		b.done = true
+		b.commit()
+	} else if err != nil {
+		b.discard()
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	switch {
+	case b.done:
+	case b.length >= 0 && b.written == b.length && b.atEOF():
+		// the caller read the whole body without reading EOF, as io.ReadFull does
+		b.done = true
+		b.commit()
+	default:
+		b.discard()
+	}
+	return b.body.Close()
+}
+
+// atEOF reports whether nothing is left to read from the body, that was read up to its Content-Length.
+func (b *cachingBody) atEOF() bool {
+	n, err := b.body.Read(make([]byte, 1))
+	return n == 0 && err == io.EOF
+}
+
+func (b *cachingBody) discard() {
+	b.done = true
+	b.abort()
+}
+
+// errBufferFull is returned by a limitedBuffer when a write does not fit.
+var errBufferFull = errors.New("webcache: buffer limit exceeded")
+
+// limitedBuffer is a buffer that refuses writes past limit bytes, a limit of zero or less means no limit.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.limit > 0 && b.Len()+len(p) > b.limit {
+		return 0, errBufferFull
+	}
+	return b.Buffer.Write(p)
+}
+
+// release drops the content of the buffer, along with its memory.
+func (b *limitedBuffer) release() {
+	b.Buffer = bytes.Buffer{}
+}
+
+// storedValue returns the response as it is stored in a cache that does not stream, followed by its body.
+func storedValue(response *http.Response, body []byte) []byte {
+	stored := *response
+	stored.Header = response.Header.Clone()
+	// the length of the body is known once it is read, it is stored with it
+	stored.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return append(dumpResponseHead(&stored), body...)
+}
+
+// dumpResponseHead returns the status line and the header of the response, as they are stored
+// before the body, or along with a body stored apart.
+func dumpResponseHead(response *http.Response) []byte {
+	text := http.StatusText(response.StatusCode)
+	if text == "" {
+		text = "status code " + strconv.Itoa(response.StatusCode)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/%d.%d %03d %s\r\n", response.ProtoMajor, response.ProtoMinor, response.StatusCode, text)
+	// the body is stored decoded, it is no longer chunked
+	_ = response.Header.WriteSubset(&b, map[string]bool{"Transfer-Encoding": true})
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func readStoredResponse(b []byte) (*http.Response, bool) {
+	v, err := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(b)), nil)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// storedResponseTTL returns the expiry of a serialized response, as written by httpCache.Set, in a cache
+// that expires entries on its own: the time it can still be served, fresh or stale, or else defaultTTL.
+// A response with validators can still be freshened by a 304 response once it can no longer be served,
+// it is kept for defaultTTL at least, and does not expire when defaultTTL is zero.
+func storedResponseTTL(b []byte, clock Clock, defaultTTL time.Duration) time.Duration {
+	response, ok := readStoredResponse(b)
+	if !ok {
+		return defaultTTL
+	}
+	ttl, ok := remainingLifetime(response.Header, clock)
+	if response.Header.Get("ETag") != "" || response.Header.Get("Last-Modified") != "" {
+		if defaultTTL <= 0 {
+			return 0
+		}
+		return max(ttl, defaultTTL)
+	}
+	if !ok || ttl <= 0 {
+		return defaultTTL
+	}
+	return ttl
 }
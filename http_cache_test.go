@@ -1,8 +1,13 @@
 package webcache
 
 import (
+	"bytes"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/stretchr/testify/assert"
@@ -18,17 +23,356 @@ func TestCacheKey(t *testing.T) {
 	r.Header.Add("Vary", "Accept, Accept-Language")
 	key := buildCacheKey(r)
 	assert.NotEmpty(t, key)
-	assert.Equal(t, "cache_key=GET_http://example.com_application/json_en-US", key.String())
+	// Vary is a response header, it is ignored on requests
+	assert.Equal(t, "cache_key=GET_http://example.com", key.String())
 
-	r, err = http.NewRequest(http.MethodGet, "http://example.com", nil)
+	variant := newCacheVariant(key, []string{"Accept", "Accept-Language"}, r.Header)
+	assert.True(t, strings.HasPrefix(variant.Key, "cache_key=GET_http://example.com_variant="))
+	assert.Equal(t, variant.Key, newCacheVariant(key, []string{"Accept", "Accept-Language"}, r.Header.Clone()).Key)
+	assert.NotEqual(t, variant.Key, newCacheVariant(key, []string{"Accept"}, r.Header).Key)
+}
+
+func TestVariantKeyIsUnambiguous(t *testing.T) {
+	key := cacheKey("cache_key=GET_http://example.com")
+	vary := []string{"A", "B"}
+
+	a := buildVariantKey(key, vary, map[string]string{"A": "x_b=y", "B": ""})
+	b := buildVariantKey(key, vary, map[string]string{"A": "x", "B": "y_b="})
+	assert.NotEqual(t, a, b)
+
+	// an empty field is not a missing one
+	empty := buildVariantKey(key, vary, map[string]string{"A": "x", "B": ""})
+	missing := buildVariantKey(key, vary, map[string]string{"A": "x"})
+	assert.NotEqual(t, empty, missing)
+}
+
+func TestHTTPCacheStoresVariants(t *testing.T) {
+	c := NewHTTPCache(NewCache())
+
+	english := newVaryRequest(t, "en-US")
+	storeAndRead(t, c, english, newVaryResponse("Accept-Language", "hello"))
+	french := newVaryRequest(t, "fr")
+	storeAndRead(t, c, french, newVaryResponse("Accept-Language", "bonjour"))
+
+	assertStoredBody(t, c, english, "hello")
+	assertStoredBody(t, c, french, "bonjour")
+	assertStoredBody(t, c, newVaryRequest(t, " en-US "), "hello")
+
+	_, ok := c.Get(newVaryRequest(t, "de"))
+	assert.False(t, ok)
+
+	// a request without the field only matches a variant stored without it
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
 	assert.NoError(t, err)
-	r.Header.Add("Accept", "application/json")
-	r.Header.Add("Accept-Language", "en-US")
-	r.Header.Add("Cache-Control", "max-age=120")
-	r.Header.Add("Date", time.Now().Format(time.RFC850))
-	r.Header.Add("Vary", "Accept")
-	key = buildCacheKey(r)
-	assert.NotEmpty(t, key)
-	assert.Equal(t, "cache_key=GET_http://example.com_application/json", key.String())
+	_, ok = c.Get(r)
+	assert.False(t, ok)
+	storeAndRead(t, c, r, newVaryResponse("Accept-Language", "default"))
+	assertStoredBody(t, c, r, "default")
+	assertStoredBody(t, c, english, "hello")
+
+	c.Delete(r)
+	_, ok = c.Get(english)
+	assert.False(t, ok)
+	_, ok = c.Get(french)
+	assert.False(t, ok)
+}
+
+func TestHTTPCacheReplacesVariantsWithPlainResponse(t *testing.T) {
+	store := NewCache()
+	c := NewHTTPCache(store)
+
+	english := newVaryRequest(t, "en-US")
+	storeAndRead(t, c, english, newVaryResponse("Accept-Language", "hello"))
+	storeAndRead(t, c, english, newVaryResponse("", "plain"))
+
+	assertStoredBody(t, c, newVaryRequest(t, "fr"), "plain")
+	_, ok := store.Get(newCacheVariant(buildCacheKey(english), []string{"Accept-Language"}, english.Header).Key)
+	assert.False(t, ok)
+}
+
+func TestHTTPCacheNeverStoresVaryWildcard(t *testing.T) {
+	c := NewHTTPCache(NewCache())
+	r := newVaryRequest(t, "en-US")
+	storeAndRead(t, c, r, newVaryResponse("*", "hello"))
+	_, ok := c.Get(r)
+	assert.False(t, ok)
+
+	storeAndRead(t, c, r, newVaryResponse("Accept-Language, *", "hello"))
+	_, ok = c.Get(r)
+	assert.False(t, ok)
+}
+
+func newVaryRequest(t *testing.T, language string) *http.Request {
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	r.Header.Set("Accept-Language", language)
+	return r
+}
+
+func newVaryResponse(vary string, body string) *http.Response {
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+	}
+	response.Header.Set("Cache-Control", "max-age=100")
+	if vary != "" {
+		response.Header.Set("Vary", vary)
+	}
+	return response
+}
+
+// storeAndRead stores the response and reads its body, which commits it to the cache.
+func storeAndRead(t *testing.T, c HTTPCache, r *http.Request, response *http.Response) {
+	c.Set(r, response)
+	_, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, response.Body.Close())
+}
+
+func assertStoredBody(t *testing.T, c HTTPCache, r *http.Request, expected string) {
+	response, ok := c.Get(r)
+	assert.True(t, ok)
+	if !ok {
+		return
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(body))
+}
+
+func TestHTTPCacheListsVariants(t *testing.T) {
+	c := NewHTTPCache(NewCache()).(*httpCache)
+	assert.Empty(t, c.variants(newVaryRequest(t, "en-US")))
+
+	english := newVaryResponse("Accept-Language", "hello")
+	english.Header.Set("ETag", `"en"`)
+	storeAndRead(t, c, newVaryRequest(t, "en-US"), english)
+	french := newVaryResponse("Accept-Language", "bonjour")
+	french.Header.Set("ETag", `"fr"`)
+	storeAndRead(t, c, newVaryRequest(t, "fr"), french)
+
+	var etags []string
+	for _, variant := range c.variants(newVaryRequest(t, "de")) {
+		etags = append(etags, variant.ETag)
+		assertStoredBody(t, c, variant.request(newVaryRequest(t, "de")), map[string]string{`"en"`: "hello", `"fr"`: "bonjour"}[variant.ETag])
+	}
+	assert.Equal(t, []string{`"fr"`, `"en"`}, etags)
+
+	// a response that does not vary is not listed, it is not read either
+	plain := newVaryResponse("", "plain")
+	plain.Header.Set("ETag", `"plain"`)
+	storeAndRead(t, c, newVaryRequest(t, "en-US"), plain)
+	assert.Empty(t, c.variants(newVaryRequest(t, "de")))
+}
+
+func TestHTTPCacheStoresResponseOnceBodyIsRead(t *testing.T) {
+	c := NewHTTPCache(NewCache())
+	r := newVaryRequest(t, "en-US")
+	response := newVaryResponse("", "hello world")
+	c.Set(r, response)
+	response.Header.Set("Cache-Control", "no-store")
+
+	b := make([]byte, 5)
+	_, err := io.ReadFull(response.Body, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	_, ok := c.Get(r)
+	assert.False(t, ok)
+
+	rest, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, " world", string(rest))
+	assertStoredBody(t, c, r, "hello world")
+	stored, _ := c.Get(r)
+	assert.Equal(t, "max-age=100", stored.Header.Get("Cache-Control"))
+}
+
+func TestHTTPCacheDiscardsAbandonedBody(t *testing.T) {
+	c := NewHTTPCache(NewCache())
+	r := newVaryRequest(t, "en-US")
+	response := newVaryResponse("", "hello world")
+	c.Set(r, response)
+
+	_, err := response.Body.Read(make([]byte, 5))
+	assert.NoError(t, err)
+	assert.NoError(t, response.Body.Close())
+	_, ok := c.Get(r)
+	assert.False(t, ok)
+}
+
+func TestHTTPCacheStoresBodyClosedAtContentLength(t *testing.T) {
+	c := NewHTTPCache(NewCache())
+	r := newVaryRequest(t, "en-US")
+	response := newVaryResponse("", "hello world")
+	response.ContentLength = 11
+	c.Set(r, response)
+
+	// the whole body is read without reading EOF
+	_, err := io.ReadFull(response.Body, make([]byte, 11))
+	assert.NoError(t, err)
+	assert.NoError(t, response.Body.Close())
+	assertStoredBody(t, c, r, "hello world")
+}
+
+func TestHTTPCacheDiscardsFailedBody(t *testing.T) {
+	c := NewHTTPCache(NewCache())
+	r := newVaryRequest(t, "en-US")
+	response := newVaryResponse("", "")
+	response.Body = io.NopCloser(io.MultiReader(strings.NewReader("hello"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+	c.Set(r, response)
+
+	_, err := io.ReadAll(response.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, ok := c.Get(r)
+	assert.False(t, ok)
+}
+
+func TestHTTPCacheMaxBufferSize(t *testing.T) {
+	c := NewHTTPCache(NewCache(), WithHTTPCacheMaxBufferSize(5))
+	r := newVaryRequest(t, "en-US")
+
+	// a body of unknown length is read whole, it is no longer buffered past the limit
+	response := newVaryResponse("", "hello world")
+	response.ContentLength = -1
+	storeAndRead(t, c, r, response)
+	_, ok := c.Get(r)
+	assert.False(t, ok)
+
+	// a body larger than the limit is not buffered at all
+	response = newVaryResponse("", "hello world")
+	response.ContentLength = 11
+	body := response.Body
+	c.Set(r, response)
+	assert.Equal(t, body, response.Body)
+
+	storeAndRead(t, c, r, newVaryResponse("", "hello"))
+	assertStoredBody(t, c, r, "hello")
+}
+
+func TestHTTPCacheStoresResponseWithoutBody(t *testing.T) {
+	c := NewHTTPCache(NewCache())
+	r := newVaryRequest(t, "en-US")
+	response := newVaryResponse("", "")
+	response.Body = http.NoBody
+	c.Set(r, response)
+	assertStoredBody(t, c, r, "")
+}
+
+func TestHTTPCacheStreamsResponses(t *testing.T) {
+	disk, err := NewDiskCache(t.TempDir())
+	assert.NoError(t, err)
+	c := NewHTTPCache(disk).(*httpCache)
+	assert.NotNil(t, c.stream)
+
+	english := newVaryRequest(t, "en-US")
+	response := newVaryResponse("", "hello")
+	response.Header.Set("Content-Length", "5")
+	response.TransferEncoding = []string{"chunked"}
+	storeAndRead(t, c, english, response)
+	assertStoredBody(t, c, english, "hello")
+	stored, ok := c.Get(english)
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), stored.ContentLength)
+	assert.Equal(t, "max-age=100", stored.Header.Get("Cache-Control"))
+	assert.NoError(t, stored.Body.Close())
+
+	// variants replace the plain response
+	storeAndRead(t, c, english, newVaryResponse("Accept-Language", "hello"))
+	storeAndRead(t, c, newVaryRequest(t, "fr"), newVaryResponse("Accept-Language", "bonjour"))
+	assertStoredBody(t, c, english, "hello")
+	assertStoredBody(t, c, newVaryRequest(t, "fr"), "bonjour")
+	assert.Len(t, c.variants(english), 2)
+
+	// an abandoned body leaves the stored variant as is
+	response = newVaryResponse("Accept-Language", "hi")
+	c.Set(english, response)
+	assert.NoError(t, response.Body.Close())
+	assertStoredBody(t, c, english, "hello")
+
+	c.Delete(english)
+	_, ok = c.Get(english)
+	assert.False(t, ok)
+	_, ok = c.Get(newVaryRequest(t, "fr"))
+	assert.False(t, ok)
+}
+
+// blockingSetCache blocks the writes of a key until release is closed, it signals blocked when one starts.
+type blockingSetCache struct {
+	Cache[string, []byte]
+	key     string
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingSetCache) Set(key string, value []byte) {
+	if key == c.key {
+		c.blocked <- struct{}{}
+		<-c.release
+	}
+	c.Cache.Set(key, value)
+}
+
+// storeBlocked stores the response for the request in the background, until the cache blocks on its write.
+func storeBlocked(t *testing.T, c HTTPCache, backend *blockingSetCache, r *http.Request, response *http.Response) chan struct{} {
+	stored := make(chan struct{})
+	go func() {
+		defer close(stored)
+		storeAndRead(t, c, r, response)
+	}()
+	<-backend.blocked
+	return stored
+}
+
+func TestHTTPCacheStoresVariantsConcurrently(t *testing.T) {
+	english := newVaryRequest(t, "en-US")
+	backend := &blockingSetCache{
+		Cache:   NewCache(),
+		key:     newCacheVariant(buildCacheKey(english), []string{"Accept-Language"}, english.Header).Key,
+		blocked: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	c := NewHTTPCache(backend)
+
+	// the variant index is not locked while a variant is written
+	stored := storeBlocked(t, c, backend, english, newVaryResponse("Accept-Language", "hello"))
+	french := newVaryRequest(t, "fr")
+	storeAndRead(t, c, french, newVaryResponse("Accept-Language", "bonjour"))
+	assertStoredBody(t, c, french, "bonjour")
+
+	close(backend.release)
+	<-stored
+	assertStoredBody(t, c, english, "hello")
+	assertStoredBody(t, c, french, "bonjour")
+}
+
+func TestHTTPCacheLocksPerKey(t *testing.T) {
+	blocked, err := http.NewRequest(http.MethodGet, "http://example.com/blocked", nil)
+	assert.NoError(t, err)
+	backend := &blockingSetCache{
+		Cache:   NewCache(),
+		key:     buildCacheKey(blocked).String(),
+		blocked: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	c := NewHTTPCache(backend).(*httpCache)
+
+	// a key that does not share the lock of the blocked one
+	var other *http.Request
+	for i := 0; other == nil; i++ {
+		r, err := http.NewRequest(http.MethodGet, "http://example.com/"+strconv.Itoa(i), nil)
+		assert.NoError(t, err)
+		if c.locks.index(buildCacheKey(r).String()) != c.locks.index(backend.key) {
+			other = r
+		}
+	}
+
+	stored := storeBlocked(t, c, backend, blocked, newVaryResponse("", "blocked"))
+	storeAndRead(t, c, other, newVaryResponse("", "hello"))
+	assertStoredBody(t, c, other, "hello")
 
+	close(backend.release)
+	<-stored
+	assertStoredBody(t, c, blocked, "blocked")
 }
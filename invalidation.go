@@ -0,0 +1,81 @@
+package webcache
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// invalidatedMethods are the methods whose stored responses are removed when their URI is invalidated.
+var invalidatedMethods = []string{http.MethodGet, http.MethodHead}
+
+// isSafeMethod reports whether the method is safe, a request with any other method can change the state
+// of the origin and invalidates the stored responses.
+// https://www.rfc-editor.org/rfc/rfc9110#section-9.2.1
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// invalidatedURIs returns the URIs whose stored responses are invalidated by the response to an unsafe request:
+// the target URI, and the URIs in the Location and Content-Location headers when they have the same origin.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.4
+func invalidatedURIs(r *http.Request, response *http.Response) []*url.URL {
+	uris := []*url.URL{r.URL}
+	for _, name := range []string{"Location", "Content-Location"} {
+		v := response.Header.Get(name)
+		if v == "" {
+			continue
+		}
+		ref, err := url.Parse(v)
+		if err != nil {
+			continue
+		}
+		u := r.URL.ResolveReference(ref)
+		if sameOrigin(u, r.URL) {
+			// the URI is written as the target URI, so that it selects the same stored responses
+			u.Scheme, u.Host = r.URL.Scheme, r.URL.Host
+			uris = append(uris, u)
+		}
+	}
+	return uris
+}
+
+// sameOrigin reports whether the URIs have the same scheme, host and port, the host being case-insensitive
+// and the port defaulting to the one of the scheme.
+// https://www.rfc-editor.org/rfc/rfc6454#section-5
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) &&
+		strings.EqualFold(a.Hostname(), b.Hostname()) &&
+		effectivePort(a) == effectivePort(b)
+}
+
+// effectivePort returns the port of the URI, or the default port of its scheme.
+func effectivePort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+// invalidate removes the stored responses, with all their variants, for the URIs affected by an unsafe request.
+// Error responses leave the stored responses in place.
+func (t *Transport) invalidate(r *http.Request, response *http.Response) {
+	if response.StatusCode >= http.StatusBadRequest {
+		return
+	}
+	for _, u := range invalidatedURIs(r, response) {
+		for _, method := range invalidatedMethods {
+			t.cache.Delete(&http.Request{Method: method, URL: u, Header: make(http.Header)})
+		}
+	}
+}
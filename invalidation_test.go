@@ -0,0 +1,120 @@
+package webcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSafeMethod(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace} {
+		assert.True(t, isSafeMethod(method), method)
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, "PURGE"} {
+		assert.False(t, isSafeMethod(method), method)
+	}
+}
+
+func TestInvalidatedURIs(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPost, "http://example.com/items", nil)
+	assert.NoError(t, err)
+	response := &http.Response{Header: make(http.Header)}
+	response.Header.Set("Location", "/items/1")
+	response.Header.Set("Content-Location", "http://other.com/items/1")
+
+	var uris []string
+	for _, u := range invalidatedURIs(r, response) {
+		uris = append(uris, u.String())
+	}
+	assert.Equal(t, []string{"http://example.com/items", "http://example.com/items/1"}, uris)
+
+	// the host is case-insensitive and the port defaults to the one of the scheme
+	response.Header.Set("Location", "http://Example.com:80/items/2")
+	response.Header.Set("Content-Location", "https://example.com/items/3")
+	uris = nil
+	for _, u := range invalidatedURIs(r, response) {
+		uris = append(uris, u.String())
+	}
+	assert.Equal(t, []string{"http://example.com/items", "http://example.com/items/2"}, uris)
+}
+
+// invalidationOrigin answers GET requests with a cacheable response, and every other request with status.
+type invalidationOrigin struct {
+	status   int
+	location string
+}
+
+func (o *invalidationOrigin) RoundTrip(r *http.Request) (*http.Response, error) {
+	header := make(http.Header)
+	status := http.StatusOK
+	if r.Method == http.MethodGet {
+		header.Set("Cache-Control", "max-age=60")
+		header.Set("Date", time.Now().Format(http.TimeFormat))
+		header.Set("Vary", "Accept")
+	} else {
+		status = o.status
+		if o.location != "" {
+			header.Set("Location", o.location)
+		}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader([]byte(r.URL.Path))),
+	}, nil
+}
+
+func TestRoundTripUnsafeMethodInvalidates(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		status      int
+		location    string
+		invalidated []string
+	}{
+		{name: "post", method: http.MethodPost, status: http.StatusCreated, location: "/items/1", invalidated: []string{"/items", "/items/1"}},
+		{name: "put", method: http.MethodPut, status: http.StatusNoContent, invalidated: []string{"/items"}},
+		{name: "delete other origin location", method: http.MethodDelete, status: http.StatusOK, location: "http://other.com/items/1", invalidated: []string{"/items"}},
+		{name: "error response", method: http.MethodPatch, status: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewCache()
+			transport := NewTransport(cache, &invalidationOrigin{status: tt.status, location: tt.location})
+
+			get := func(path, accept string) *http.Request {
+				r, err := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+				assert.NoError(t, err)
+				r.Header.Set("Accept", accept)
+				return r
+			}
+			for _, path := range []string{"/items", "/items/1"} {
+				for _, accept := range []string{"text/html", "application/json"} {
+					_, err := roundTripAndRead(t, transport, get(path, accept))
+					assert.NoError(t, err)
+				}
+			}
+
+			r, err := http.NewRequest(tt.method, "http://example.com/items", nil)
+			assert.NoError(t, err)
+			response, err := transport.RoundTrip(r)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, response.StatusCode)
+
+			for _, path := range []string{"/items", "/items/1"} {
+				invalidated := false
+				for _, p := range tt.invalidated {
+					invalidated = invalidated || p == path
+				}
+				for _, accept := range []string{"text/html", "application/json"} {
+					_, ok := transport.cache.Get(get(path, accept))
+					assert.Equal(t, !invalidated, ok, "%s %s", path, accept)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package webcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type lruCache struct {
+	mu    sync.Mutex
+	clock Clock
+
+	maxBytes   int64
+	maxEntries int
+
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRUCache returns a Cache bounded by the total byte length of the stored values
+// and by the number of entries. When either bound is exceeded, the least recently used
+// entries are evicted. A bound of zero or less disables it.
+func NewLRUCache(maxBytes int64, maxEntries int) Cache[string, []byte] {
+	return &lruCache{
+		clock:      NewClock(),
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if expired(entry.expires, c.clock) {
+		c.remove(key)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *lruCache) Set(key string, value []byte) {
+	c.SetWithTTL(key, value, 0)
+}
+
+func (c *lruCache) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// a value that can never fit is not stored, and must not leave an older value behind
+	if c.maxBytes > 0 && int64(len(value)) > c.maxBytes {
+		c.remove(key)
+		return
+	}
+
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*lruEntry)
+		c.size += int64(len(value)) - int64(len(entry.value))
+		entry.value = value
+		entry.expires = expiresAfter(ttl, c.clock)
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, expires: expiresAfter(ttl, c.clock)})
+		c.size += int64(len(value))
+	}
+
+	c.evict()
+}
+
+func (c *lruCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+// evict drops the least recently used entries until the cache is within its bounds.
+func (c *lruCache) evict() {
+	for c.overBudget() {
+		e := c.ll.Back()
+		if e == nil {
+			return
+		}
+		c.remove(e.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) overBudget() bool {
+	if c.maxBytes > 0 && c.size > c.maxBytes {
+		return true
+	}
+	if c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		return true
+	}
+	return false
+}
+
+func (c *lruCache) remove(key string) {
+	e, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.ll.Remove(e)
+	delete(c.items, key)
+	c.size -= int64(len(e.Value.(*lruEntry).value))
+}
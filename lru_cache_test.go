@@ -0,0 +1,113 @@
+package webcache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := NewLRUCache(0, 0)
+	assert.NotNil(t, c)
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	c.Set("a", []byte("hello world"))
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), v)
+
+	c.Delete("a")
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+}
+
+func TestLRUCacheEvictsByEntries(t *testing.T) {
+	c := NewLRUCache(0, 2)
+	c.Set("a", []byte("1"))
+	c.Set("b", []byte("2"))
+
+	// reading a makes b the least recently used entry
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+
+	c.Set("c", []byte("3"))
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	_, ok = c.Get("a")
+	assert.True(t, ok)
+	_, ok = c.Get("c")
+	assert.True(t, ok)
+}
+
+func TestLRUCacheEvictsByBytes(t *testing.T) {
+	c := NewLRUCache(10, 0)
+	c.Set("a", []byte("12345"))
+	c.Set("b", []byte("12345"))
+	c.Set("c", []byte("123"))
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+	_, ok = c.Get("b")
+	assert.True(t, ok)
+	_, ok = c.Get("c")
+	assert.True(t, ok)
+
+	// replacing a value charges only the difference
+	c.Set("c", []byte("12345"))
+	_, ok = c.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), c.(*lruCache).size)
+}
+
+func TestLRUCacheRejectsOversizedValue(t *testing.T) {
+	c := NewLRUCache(4, 0)
+	c.Set("a", []byte("1234"))
+	c.Set("a", []byte("12345"))
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), c.(*lruCache).size)
+}
+
+func TestLRUCacheConcurrentAccess(t *testing.T) {
+	c := NewLRUCache(1024, 16)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key-%d", (i*100+j)%32)
+				c.Set(key, []byte(key))
+				c.Get(key)
+				if j%10 == 0 {
+					c.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lru := c.(*lruCache)
+	assert.LessOrEqual(t, lru.ll.Len(), 16)
+	assert.LessOrEqual(t, lru.size, int64(1024))
+	assert.Equal(t, lru.ll.Len(), len(lru.items))
+}
+
+func TestLRUCacheSetWithTTL(t *testing.T) {
+	c := NewLRUCache(0, 0).(*lruCache)
+	clock := &mockClock{now: time.Now()}
+	c.clock = clock
+
+	c.SetWithTTL("a", []byte("hello world"), time.Minute)
+	clock.Advance(time.Minute)
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.ll.Len())
+	assert.Equal(t, int64(0), c.size)
+}
@@ -0,0 +1,248 @@
+package webcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidMemcachedReply = errors.New("invalid memcached reply")
+)
+
+// memcachedMaxRelativeExpiry is the largest expiry memcached accepts as relative seconds,
+// longer expiries must be sent as unix timestamps.
+const memcachedMaxRelativeExpiry = 30 * 24 * time.Hour
+
+type memcachedError string
+
+func (e memcachedError) Error() string {
+	return "memcached: " + string(e)
+}
+
+type memcachedCache struct {
+	pool        *connPool
+	clock       Clock
+	defaultTTL  time.Duration
+	maxItemSize int
+
+	poolSize    int
+	dialTimeout time.Duration
+	ioTimeout   time.Duration
+}
+
+type MemcachedCacheOption func(*memcachedCache)
+
+// WithMemcachedPoolSize sets how many idle connections are kept for reuse.
+func WithMemcachedPoolSize(n int) MemcachedCacheOption {
+	return func(c *memcachedCache) {
+		c.poolSize = n
+	}
+}
+
+func WithMemcachedDialTimeout(d time.Duration) MemcachedCacheOption {
+	return func(c *memcachedCache) {
+		c.dialTimeout = d
+	}
+}
+
+// WithMemcachedIOTimeout bounds the time spent on a single command.
+func WithMemcachedIOTimeout(d time.Duration) MemcachedCacheOption {
+	return func(c *memcachedCache) {
+		c.ioTimeout = d
+	}
+}
+
+// WithMemcachedMaxItemSize sets the largest value that is sent to the server.
+// It should match the item size limit of the server (-I), which is 1MB by default.
+func WithMemcachedMaxItemSize(n int) MemcachedCacheOption {
+	return func(c *memcachedCache) {
+		c.maxItemSize = n
+	}
+}
+
+// WithMemcachedDefaultTTL sets the expiry of the entries that are not responses, of the responses without explicit
+// expiration, and of the responses that can no longer be served. The responses with validators are kept at
+// least that long, to be freshened by a 304 response. Zero means no expiry.
+func WithMemcachedDefaultTTL(d time.Duration) MemcachedCacheOption {
+	return func(c *memcachedCache) {
+		c.defaultTTL = d
+	}
+}
+
+// NewMemcachedCache returns a Cache that stores entries on a server speaking the memcached text protocol.
+// Keys are hashed to fit the 250 bytes key limit of memcached, and responses larger than the
+// item size limit are not stored.
+func NewMemcachedCache(addr string, opts ...MemcachedCacheOption) Cache[string, []byte] {
+	c := &memcachedCache{
+		clock:       NewClock(),
+		maxItemSize: 1024 * 1024,
+		poolSize:    8,
+		dialTimeout: 5 * time.Second,
+		ioTimeout:   5 * time.Second,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	c.pool = newConnPool(addr, c.poolSize, c.dialTimeout, c.ioTimeout)
+	return c
+}
+
+func (c *memcachedCache) Get(key string) ([]byte, bool) {
+	var value []byte
+	var found bool
+	err := c.do(func(conn *poolConn) error {
+		if _, err := fmt.Fprintf(conn.w, "get %s\r\n", memcachedKey(key)); err != nil {
+			return err
+		}
+		if err := conn.w.Flush(); err != nil {
+			return err
+		}
+
+		for {
+			line, err := readMemcachedLine(conn)
+			if err != nil {
+				return err
+			}
+			if line == "END" {
+				return nil
+			}
+
+			// VALUE <key> <flags> <bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[0] != "VALUE" {
+				return memcachedReplyError(line)
+			}
+			n, err := strconv.Atoi(fields[3])
+			if err != nil || n < 0 {
+				return ErrInvalidMemcachedReply
+			}
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(conn.r, data); err != nil {
+				return err
+			}
+			value, found = data[:n], true
+		}
+	})
+	if err != nil || !found {
+		return nil, false
+	}
+	return value, true
+}
+
+func (c *memcachedCache) Set(key string, value []byte) {
+	c.SetWithTTL(key, value, storedResponseTTL(value, c.clock, c.defaultTTL))
+}
+
+func (c *memcachedCache) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	// an oversized response would be refused by the server,
+	// remove the previous one so it is not served in place of the new response
+	if c.maxItemSize > 0 && len(value) > c.maxItemSize {
+		c.Delete(key)
+		return
+	}
+
+	_ = c.do(func(conn *poolConn) error {
+		_, err := fmt.Fprintf(conn.w, "set %s 0 %d %d\r\n", memcachedKey(key), c.expiry(ttl), len(value))
+		if err != nil {
+			return err
+		}
+		if _, err := conn.w.Write(value); err != nil {
+			return err
+		}
+		if _, err := conn.w.WriteString("\r\n"); err != nil {
+			return err
+		}
+		if err := conn.w.Flush(); err != nil {
+			return err
+		}
+
+		line, err := readMemcachedLine(conn)
+		if err != nil {
+			return err
+		}
+		if line != "STORED" {
+			return memcachedReplyError(line)
+		}
+		return nil
+	})
+}
+
+func (c *memcachedCache) Delete(key string) {
+	_ = c.do(func(conn *poolConn) error {
+		if _, err := fmt.Fprintf(conn.w, "delete %s\r\n", memcachedKey(key)); err != nil {
+			return err
+		}
+		if err := conn.w.Flush(); err != nil {
+			return err
+		}
+
+		line, err := readMemcachedLine(conn)
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return memcachedReplyError(line)
+		}
+		return nil
+	})
+}
+
+func (c *memcachedCache) do(command func(conn *poolConn) error) error {
+	conn, err := c.pool.get()
+	if err != nil {
+		return err
+	}
+
+	err = command(conn)
+	var replyErr memcachedError
+	if errors.As(err, &replyErr) {
+		// an error reply leaves the connection usable
+		c.pool.put(conn, nil)
+		return err
+	}
+	c.pool.put(conn, err)
+	return err
+}
+
+// expiry converts the ttl to the exptime argument of a storage command.
+func (c *memcachedCache) expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > memcachedMaxRelativeExpiry {
+		return c.clock.Now().Add(ttl).Unix()
+	}
+	// round up, a zero exptime would mean no expiry at all
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// memcachedKey hashes the cache key, since memcached keys are limited to 250 bytes
+// and must not contain whitespace or control characters.
+func memcachedKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "webcache:" + hex.EncodeToString(sum[:])
+}
+
+func readMemcachedLine(conn *poolConn) (string, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", ErrInvalidMemcachedReply
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+func memcachedReplyError(line string) error {
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") || line == "NOT_STORED" {
+		return memcachedError(line)
+	}
+	return ErrInvalidMemcachedReply
+}
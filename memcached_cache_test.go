@@ -0,0 +1,250 @@
+package webcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemcachedCache(t *testing.T) {
+	server := newFakeMemcachedServer(t, 1024*1024)
+	c := NewMemcachedCache(server.addr())
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	c.Set("a", []byte("hello\r\nworld"))
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello\r\nworld"), v)
+	assert.Equal(t, int64(0), server.exptime("a"))
+
+	c.Delete("a")
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+
+	assert.Equal(t, 1, server.connections())
+}
+
+func TestMemcachedCacheHashesLongKeys(t *testing.T) {
+	server := newFakeMemcachedServer(t, 1024*1024)
+	c := NewMemcachedCache(server.addr())
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com/"+strings.Repeat("a", 300)+"?q=with space", nil)
+	assert.NoError(t, err)
+	key := buildCacheKey(r).String()
+	assert.Greater(t, len(key), 250)
+
+	c.Set(key, []byte("hello world"))
+	v, ok := c.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), v)
+	assert.LessOrEqual(t, len(memcachedKey(key)), 250)
+}
+
+func TestMemcachedCacheRefusesOversizedValues(t *testing.T) {
+	server := newFakeMemcachedServer(t, 16)
+	c := NewMemcachedCache(server.addr(), WithMemcachedMaxItemSize(16))
+
+	c.Set("a", []byte("small"))
+	c.Set("a", bytes.Repeat([]byte("a"), 17))
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	// the server refusing an item does not break the connection
+	c = NewMemcachedCache(server.addr(), WithMemcachedMaxItemSize(0))
+	c.Set("b", bytes.Repeat([]byte("a"), 17))
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	c.Set("b", []byte("small"))
+	_, ok = c.Get("b")
+	assert.True(t, ok)
+}
+
+func TestMemcachedCacheExpiresWithFreshnessLifetime(t *testing.T) {
+	server := newFakeMemcachedServer(t, 1024*1024)
+	c := NewMemcachedCache(server.addr())
+
+	response := http.Response{Header: make(http.Header), StatusCode: http.StatusOK}
+	response.Header.Set("Cache-Control", "max-age=100")
+	response.Header.Set("Date", time.Now().Format(http.TimeFormat))
+	b, err := httputil.DumpResponse(&response, true)
+	assert.NoError(t, err)
+
+	c.Set("a", b)
+	assert.InDelta(t, 100, server.exptime("a"), 1)
+
+	response.Header.Set("Cache-Control", fmt.Sprintf("max-age=%d", 60*24*60*60))
+	b, err = httputil.DumpResponse(&response, true)
+	assert.NoError(t, err)
+
+	c.Set("a", b)
+	assert.InDelta(t, time.Now().Add(60*24*time.Hour).Unix(), server.exptime("a"), 1)
+
+	// the entry is kept as long as the response can be served stale
+	response.Header.Set("Cache-Control", "max-age=1, stale-while-revalidate=600")
+	b, err = httputil.DumpResponse(&response, true)
+	assert.NoError(t, err)
+
+	c.Set("a", b)
+	assert.InDelta(t, 601, server.exptime("a"), 1)
+}
+
+func TestTransportWithMemcachedCache(t *testing.T) {
+	server := newFakeMemcachedServer(t, 1024*1024)
+	cache := NewMemcachedCache(server.addr())
+
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Cache-Control", "max-age=100")
+	responseHeaders.Set("Date", time.Now().Format(http.TimeFormat))
+	transport := NewTransport(cache, &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte("hello world"))),
+			Header:     responseHeaders,
+		},
+	})
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+}
+
+// fakeMemcachedServer is an in-process server that understands the get, set and delete commands.
+type fakeMemcachedServer struct {
+	t           *testing.T
+	listener    net.Listener
+	maxItemSize int
+
+	mu       sync.Mutex
+	values   map[string][]byte
+	exptimes map[string]int64
+	accepted int
+}
+
+func newFakeMemcachedServer(t *testing.T, maxItemSize int) *fakeMemcachedServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &fakeMemcachedServer{
+		t:           t,
+		listener:    l,
+		maxItemSize: maxItemSize,
+		values:      make(map[string][]byte),
+		exptimes:    make(map[string]int64),
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeMemcachedServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeMemcachedServer) exptime(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exptimes[memcachedKey(key)]
+}
+
+func (s *fakeMemcachedServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+func (s *fakeMemcachedServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.accepted++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeMemcachedServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			w.WriteString("ERROR\r\n")
+			w.Flush()
+			continue
+		}
+		assert.LessOrEqual(s.t, len(fields[1]), 250)
+
+		switch fields[0] {
+		case "get":
+			s.mu.Lock()
+			v, ok := s.values[fields[1]]
+			s.mu.Unlock()
+			if ok {
+				fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", fields[1], len(v), v)
+			}
+			w.WriteString("END\r\n")
+
+		case "set":
+			exptime, _ := strconv.ParseInt(fields[3], 10, 64)
+			n, _ := strconv.Atoi(fields[4])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			if n > s.maxItemSize {
+				w.WriteString("SERVER_ERROR object too large for cache\r\n")
+				break
+			}
+			s.mu.Lock()
+			s.values[fields[1]] = data[:n]
+			s.exptimes[fields[1]] = exptime
+			s.mu.Unlock()
+			w.WriteString("STORED\r\n")
+
+		case "delete":
+			s.mu.Lock()
+			_, ok := s.values[fields[1]]
+			delete(s.values, fields[1])
+			s.mu.Unlock()
+			if ok {
+				w.WriteString("DELETED\r\n")
+				break
+			}
+			w.WriteString("NOT_FOUND\r\n")
+
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package webcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidRange         = errors.New("invalid range")
+	ErrUnsatisfiableRange   = errors.New("unsatisfiable range")
+	ErrUnsupportedRangeUnit = errors.New("unsupported range unit")
+	ErrIgnoredRanges        = errors.New("too many, overlapping or unordered ranges")
+)
+
+// maxRanges bounds the number of ranges of a request, a request with more ranges is sent the whole representation.
+const maxRanges = 16
+
+// byteRange is a satisfiable range of a representation, its bounds are inclusive.
+type byteRange struct {
+	first, last int64
+}
+
+func (r byteRange) length() int64 {
+	return r.last - r.first + 1
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.first, r.last, size)
+}
+
+// parseRange returns the satisfiable ranges of a Range header value for a representation of the given size.
+// It returns ErrUnsatisfiableRange when none of the ranges can be satisfied, and ErrIgnoredRanges when
+// there are more than maxRanges ranges or when the satisfiable ranges overlap or are not in ascending order,
+// which a server may ignore, so that the ranges are read in a single pass and never repeat the representation.
+// https://www.rfc-editor.org/rfc/rfc9110#section-14.1.2
+// https://www.rfc-editor.org/rfc/rfc9110#section-15.3.7.3
+func parseRange(s string, size int64) ([]byteRange, error) {
+	unit, set, ok := strings.Cut(s, "=")
+	if !ok {
+		return nil, ErrInvalidRange
+	}
+	if strings.TrimSpace(unit) != "bytes" {
+		return nil, ErrUnsupportedRangeUnit
+	}
+
+	specs := strings.Split(set, ",")
+	if len(specs) > maxRanges {
+		return nil, ErrIgnoredRanges
+	}
+	var ranges []byteRange
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, ErrInvalidRange
+		}
+		start, end = strings.TrimSpace(start), strings.TrimSpace(end)
+
+		var r byteRange
+		if start == "" {
+			// a suffix range selects the last bytes of the representation
+			suffix, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || suffix < 0 {
+				return nil, ErrInvalidRange
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			r = byteRange{first: max(0, size-suffix), last: size - 1}
+		} else {
+			first, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || first < 0 {
+				return nil, ErrInvalidRange
+			}
+			last := size - 1
+			if end != "" {
+				if last, err = strconv.ParseInt(end, 10, 64); err != nil || last < first {
+					return nil, ErrInvalidRange
+				}
+				last = min(last, size-1)
+			}
+			if first >= size {
+				continue
+			}
+			r = byteRange{first: first, last: last}
+		}
+		if len(ranges) > 0 && r.first <= ranges[len(ranges)-1].last {
+			return nil, ErrIgnoredRanges
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, ErrUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether the If-Range precondition of the request holds for the stored response,
+// a request without If-Range always matches.
+// An entity tag matches with the strong comparison, a date matches the Last-Modified date exactly.
+// https://www.rfc-editor.org/rfc/rfc9110#section-13.1.5
+func ifRangeMatches(r *http.Request, header http.Header) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := header.Get("ETag")
+		return !strings.HasPrefix(ifRange, "W/") && !strings.HasPrefix(etag, "W/") && etag == ifRange
+	}
+
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := lastModifiedFromHeader(header)
+	return err == nil && lastModified.Equal(date)
+}
+
+// serveRange answers a range request from a stored complete response.
+// It returns the response unchanged when the request has no Range, when the Range is invalid or ignored,
+// when If-Range does not match, or when the size of the stored response is unknown, in which case the whole
+// representation is sent. The ranges are read from the stored body as the client reads them.
+// https://www.rfc-editor.org/rfc/rfc9110#section-14.2
+func serveRange(r *http.Request, response *http.Response) (*http.Response, error) {
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" || r.Method != http.MethodGet || response.StatusCode != http.StatusOK || !ifRangeMatches(r, response.Header) {
+		return response, nil
+	}
+	size := response.ContentLength
+	if size < 0 {
+		return response, nil
+	}
+
+	ranges, err := parseRange(rangeHeader, size)
+	switch {
+	case errors.Is(err, ErrUnsatisfiableRange):
+		response.Body.Close()
+		response = partialResponse(response, http.StatusRequestedRangeNotSatisfiable, http.NoBody, 0)
+		response.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return response, nil
+	case err != nil:
+		return response, nil
+	}
+
+	if len(ranges) == 1 {
+		rng := ranges[0]
+		body := &rangeReader{body: response.Body, skip: rng.first, remaining: rng.length()}
+		response = partialResponse(response, http.StatusPartialContent, body, rng.length())
+		response.Header.Set("Content-Range", rng.contentRange(size))
+		return response, nil
+	}
+
+	// the parts are read in a single pass, the boundaries and part headers being interleaved with the ranges
+	// https://www.rfc-editor.org/rfc/rfc9110#section-14.6
+	var (
+		readers []io.Reader
+		length  int64
+		offset  int64
+		framing bytes.Buffer
+	)
+	w := multipart.NewWriter(&framing)
+	for _, rng := range ranges {
+		partHeader := make(textproto.MIMEHeader)
+		if contentType := response.Header.Get("Content-Type"); contentType != "" {
+			partHeader.Set("Content-Type", contentType)
+		}
+		partHeader.Set("Content-Range", rng.contentRange(size))
+		if _, err := w.CreatePart(partHeader); err != nil {
+			return nil, err
+		}
+		readers = append(readers, bytes.NewReader(bytes.Clone(framing.Bytes())))
+		length += int64(framing.Len()) + rng.length()
+		framing.Reset()
+
+		readers = append(readers, &rangeReader{body: response.Body, skip: rng.first - offset, remaining: rng.length()})
+		offset = rng.last + 1
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	readers = append(readers, bytes.NewReader(framing.Bytes()))
+	length += int64(framing.Len())
+
+	body := struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(readers...), response.Body}
+	response = partialResponse(response, http.StatusPartialContent, body, length)
+	response.Header.Set("Content-Type", "multipart/byteranges; boundary="+w.Boundary())
+	return response, nil
+}
+
+// rangeReader reads a range of a body, after skipping the bytes that precede it. The ranges of a body are
+// read in order, skip being counted from the end of the previous range.
+type rangeReader struct {
+	body      io.ReadCloser
+	skip      int64
+	remaining int64
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.skip > 0 {
+		n, err := io.CopyN(io.Discard, r.body, r.skip)
+		r.skip -= n
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.body.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *rangeReader) Close() error {
+	return r.body.Close()
+}
+
+// partialResponse returns a copy of the response with the status code and body of the given length.
+func partialResponse(response *http.Response, statusCode int, body io.ReadCloser, length int64) *http.Response {
+	partial := *response
+	partial.StatusCode = statusCode
+	partial.Status = fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))
+	partial.Header = response.Header.Clone()
+	partial.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	partial.ContentLength = length
+	partial.Body = body
+	return &partial
+}
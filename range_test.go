@@ -0,0 +1,212 @@
+package webcache
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		value  string
+		ranges []byteRange
+		err    error
+	}{
+		{value: "bytes=0-4", ranges: []byteRange{{0, 4}}},
+		{value: "bytes=5-", ranges: []byteRange{{5, 9}}},
+		{value: "bytes=-3", ranges: []byteRange{{7, 9}}},
+		{value: "bytes=-30", ranges: []byteRange{{0, 9}}},
+		{value: "bytes=8-20", ranges: []byteRange{{8, 9}}},
+		{value: "bytes=0-1, 4-5", ranges: []byteRange{{0, 1}, {4, 5}}},
+		{value: "bytes=0-1, 20-30", ranges: []byteRange{{0, 1}}},
+		{value: "bytes=10-", err: ErrUnsatisfiableRange},
+		{value: "bytes=5-1", err: ErrInvalidRange},
+		{value: "bytes=a-b", err: ErrInvalidRange},
+		{value: "0-4", err: ErrInvalidRange},
+		{value: "items=0-4", err: ErrUnsupportedRangeUnit},
+		{value: "bytes=0-,0-", err: ErrIgnoredRanges},
+		{value: "bytes=0-4, 3-5", err: ErrIgnoredRanges},
+		{value: "bytes=4-5, 0-1", err: ErrIgnoredRanges},
+		{value: "bytes=0-0" + strings.Repeat(",0-0", maxRanges), err: ErrIgnoredRanges},
+	}
+	for _, tt := range tests {
+		ranges, err := parseRange(tt.value, 10)
+		assert.ErrorIs(t, err, tt.err, tt.value)
+		assert.Equal(t, tt.ranges, ranges, tt.value)
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	lastModified := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	header := make(http.Header)
+	header.Set("ETag", `"a"`)
+	header.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	assert.True(t, ifRangeMatches(r, header))
+
+	r.Header.Set("If-Range", `"a"`)
+	assert.True(t, ifRangeMatches(r, header))
+	r.Header.Set("If-Range", `"b"`)
+	assert.False(t, ifRangeMatches(r, header))
+	r.Header.Set("If-Range", `W/"a"`)
+	assert.False(t, ifRangeMatches(r, header))
+	r.Header.Set("If-Range", lastModified.Format(http.TimeFormat))
+	assert.True(t, ifRangeMatches(r, header))
+	r.Header.Set("If-Range", lastModified.Add(time.Second).Format(http.TimeFormat))
+	assert.False(t, ifRangeMatches(r, header))
+}
+
+func newRangeTransport(t *testing.T) (*Transport, *mockRoundTripper) {
+	header := make(http.Header)
+	header.Set("Cache-Control", "max-age=60")
+	header.Set("Date", time.Now().Format(http.TimeFormat))
+	header.Set("ETag", `"a"`)
+	header.Set("Content-Type", "text/plain")
+	origin := &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewReader([]byte("0123456789"))),
+		},
+	}
+	transport := NewTransport(NewCache(), origin)
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	return transport, origin
+}
+
+func rangeRequest(t *testing.T, rangeHeader, ifRange string) *http.Request {
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	r.Header.Set("Range", rangeHeader)
+	if ifRange != "" {
+		r.Header.Set("If-Range", ifRange)
+	}
+	return r
+}
+
+func TestRoundTripSingleRange(t *testing.T) {
+	transport, origin := newRangeTransport(t)
+
+	response, err := transport.RoundTrip(rangeRequest(t, "bytes=2-5", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "bytes 2-5/10", response.Header.Get("Content-Range"))
+	assert.Equal(t, "4", response.Header.Get("Content-Length"))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "2345", string(body))
+	assert.Equal(t, 1, origin.calls)
+}
+
+func TestRoundTripMultipleRanges(t *testing.T) {
+	transport, _ := newRangeTransport(t)
+
+	response, err := transport.RoundTrip(rangeRequest(t, "bytes=0-1,-2", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(len(body)), response.Header.Get("Content-Length"))
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var contentRanges, bodies []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+		b, err := io.ReadAll(part)
+		assert.NoError(t, err)
+		contentRanges = append(contentRanges, part.Header.Get("Content-Range"))
+		bodies = append(bodies, string(b))
+	}
+	assert.Equal(t, []string{"bytes 0-1/10", "bytes 8-9/10"}, contentRanges)
+	assert.Equal(t, []string{"01", "89"}, bodies)
+}
+
+func TestRoundTripIgnoredRanges(t *testing.T) {
+	transport, _ := newRangeTransport(t)
+
+	response, err := transport.RoundTrip(rangeRequest(t, "bytes=0-,0-,0-", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(body))
+}
+
+func TestRoundTripUnsatisfiableRange(t *testing.T) {
+	transport, _ := newRangeTransport(t)
+
+	response, err := transport.RoundTrip(rangeRequest(t, "bytes=20-", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, response.StatusCode)
+	assert.Equal(t, "bytes */10", response.Header.Get("Content-Range"))
+}
+
+func TestRoundTripIfRange(t *testing.T) {
+	transport, _ := newRangeTransport(t)
+
+	response, err := transport.RoundTrip(rangeRequest(t, "bytes=0-1", `"a"`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+
+	// the representation changed, the whole of it is sent
+	response, err = transport.RoundTrip(rangeRequest(t, "bytes=0-1", `"b"`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(body))
+}
+
+func TestRoundTripPartialResponseIsNotStored(t *testing.T) {
+	transport, origin := newRangeTransport(t)
+	header := origin.response.Header.Clone()
+	header.Set("Content-Range", "bytes 0-1/10")
+	origin.response = &http.Response{
+		StatusCode: http.StatusPartialContent,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader([]byte("01"))),
+	}
+
+	// the request is forwarded, and the partial response of the origin leaves the complete response in place
+	r := rangeRequest(t, "bytes=0-1", "")
+	r.Header.Set("Cache-Control", "no-cache")
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+
+	r, err = http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(body))
+	assert.Equal(t, 2, origin.calls)
+}
@@ -0,0 +1,238 @@
+package webcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrInvalidRESPReply = errors.New("invalid RESP reply")
+)
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisCache struct {
+	pool       *connPool
+	clock      Clock
+	defaultTTL time.Duration
+
+	poolSize    int
+	dialTimeout time.Duration
+	ioTimeout   time.Duration
+}
+
+type RedisCacheOption func(*redisCache)
+
+// WithRedisPoolSize sets how many idle connections are kept for reuse.
+func WithRedisPoolSize(n int) RedisCacheOption {
+	return func(c *redisCache) {
+		c.poolSize = n
+	}
+}
+
+func WithRedisDialTimeout(d time.Duration) RedisCacheOption {
+	return func(c *redisCache) {
+		c.dialTimeout = d
+	}
+}
+
+// WithRedisIOTimeout bounds the time spent on a single command.
+func WithRedisIOTimeout(d time.Duration) RedisCacheOption {
+	return func(c *redisCache) {
+		c.ioTimeout = d
+	}
+}
+
+// WithRedisDefaultTTL sets the expiry of the entries that are not responses, of the responses without explicit
+// expiration, and of the responses that can no longer be served. The responses with validators are kept at
+// least that long, to be freshened by a 304 response. Zero means no expiry.
+func WithRedisDefaultTTL(d time.Duration) RedisCacheOption {
+	return func(c *redisCache) {
+		c.defaultTTL = d
+	}
+}
+
+// NewRedisCache returns a Cache that stores entries on a server speaking the Redis protocol (RESP).
+// Each entry expires on the server once the stored response can no longer be served, fresh or stale.
+func NewRedisCache(addr string, opts ...RedisCacheOption) Cache[string, []byte] {
+	c := &redisCache{
+		clock:       NewClock(),
+		poolSize:    8,
+		dialTimeout: 5 * time.Second,
+		ioTimeout:   5 * time.Second,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	c.pool = newConnPool(addr, c.poolSize, c.dialTimeout, c.ioTimeout)
+	return c
+}
+
+func (c *redisCache) Get(key string) ([]byte, bool) {
+	reply, err := c.do("GET", []byte(key))
+	if err != nil || reply.null {
+		return nil, false
+	}
+	return reply.bulk, true
+}
+
+func (c *redisCache) Set(key string, value []byte) {
+	c.SetWithTTL(key, value, storedResponseTTL(value, c.clock, c.defaultTTL))
+}
+
+func (c *redisCache) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	args := [][]byte{[]byte(key), value}
+	if ttl > 0 {
+		args = append(args, []byte("PX"), []byte(strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)))
+	}
+	_, _ = c.do("SET", args...)
+}
+
+func (c *redisCache) Delete(key string) {
+	_, _ = c.do("DEL", []byte(key))
+}
+
+func (c *redisCache) do(command string, args ...[]byte) (respReply, error) {
+	conn, err := c.pool.get()
+	if err != nil {
+		return respReply{}, err
+	}
+
+	reply, err := c.roundTrip(conn, command, args...)
+	var replyErr redisError
+	if errors.As(err, &replyErr) {
+		// an error reply leaves the connection usable
+		c.pool.put(conn, nil)
+		return reply, err
+	}
+	c.pool.put(conn, err)
+	return reply, err
+}
+
+func (c *redisCache) roundTrip(conn *poolConn, command string, args ...[]byte) (respReply, error) {
+	if err := writeRESPCommand(conn.w, append([][]byte{[]byte(command)}, args...)...); err != nil {
+		return respReply{}, err
+	}
+	if err := conn.w.Flush(); err != nil {
+		return respReply{}, err
+	}
+
+	reply, err := readRESPReply(conn.r)
+	if err != nil {
+		return respReply{}, err
+	}
+	if reply.kind == '-' {
+		return reply, redisError(reply.str)
+	}
+	return reply, nil
+}
+
+// respReply is a reply of the Redis serialization protocol.
+// https://redis.io/docs/reference/protocol-spec/
+type respReply struct {
+	kind  byte
+	str   string
+	num   int64
+	bulk  []byte
+	array []respReply
+	null  bool
+}
+
+func writeRESPCommand(w *bufio.Writer, args ...[]byte) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n", len(arg)); err != nil {
+			return err
+		}
+		if _, err := w.Write(arg); err != nil {
+			return err
+		}
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readRESPReply(r *bufio.Reader) (respReply, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return respReply{}, err
+	}
+	if len(line) == 0 {
+		return respReply{}, ErrInvalidRESPReply
+	}
+
+	reply := respReply{kind: line[0]}
+	switch reply.kind {
+	case '+', '-':
+		reply.str = line[1:]
+		return reply, nil
+
+	case ':':
+		reply.num, err = strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return respReply{}, ErrInvalidRESPReply
+		}
+		return reply, nil
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return respReply{}, ErrInvalidRESPReply
+		}
+		if n < 0 {
+			reply.null = true
+			return reply, nil
+		}
+		reply.bulk = make([]byte, n+2)
+		if _, err := io.ReadFull(r, reply.bulk); err != nil {
+			return respReply{}, err
+		}
+		reply.bulk = reply.bulk[:n]
+		return reply, nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return respReply{}, ErrInvalidRESPReply
+		}
+		if n < 0 {
+			reply.null = true
+			return reply, nil
+		}
+		reply.array = make([]respReply, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := readRESPReply(r)
+			if err != nil {
+				return respReply{}, err
+			}
+			reply.array = append(reply.array, item)
+		}
+		return reply, nil
+
+	default:
+		return respReply{}, ErrInvalidRESPReply
+	}
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", ErrInvalidRESPReply
+	}
+	return line[:len(line)-2], nil
+}
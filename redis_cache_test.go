@@ -0,0 +1,314 @@
+package webcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisCache(t *testing.T) {
+	server := newFakeRedisServer(t)
+	c := NewRedisCache(server.addr())
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	c.Set("a", []byte("hello\r\nworld"))
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello\r\nworld"), v)
+	assert.Equal(t, time.Duration(0), server.ttl("a"))
+
+	c.Delete("a")
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+
+	// every command was served over the same pooled connection
+	assert.Equal(t, 1, server.connections())
+}
+
+func TestRedisCacheExpiresWithFreshnessLifetime(t *testing.T) {
+	server := newFakeRedisServer(t)
+	c := NewRedisCache(server.addr())
+
+	response := http.Response{Header: make(http.Header), StatusCode: http.StatusOK}
+	response.Header.Set("Cache-Control", "max-age=100")
+	response.Header.Set("Date", time.Now().Add(-10*time.Second).Format(http.TimeFormat))
+	b, err := httputil.DumpResponse(&response, true)
+	assert.NoError(t, err)
+
+	c.Set("a", b)
+	ttl := server.ttl("a")
+	assert.LessOrEqual(t, ttl, 90*time.Second)
+	assert.Greater(t, ttl, 88*time.Second)
+}
+
+func TestRedisCacheDefaultTTLForStaleResponse(t *testing.T) {
+	server := newFakeRedisServer(t)
+	c := NewRedisCache(server.addr(), WithRedisDefaultTTL(time.Minute))
+
+	response := http.Response{Header: make(http.Header), StatusCode: http.StatusOK}
+	response.Header.Set("Cache-Control", "max-age=0")
+	response.Header.Set("Date", time.Now().Add(-10*time.Second).Format(http.TimeFormat))
+	response.Header.Set("Etag", "123")
+	b, err := httputil.DumpResponse(&response, true)
+	assert.NoError(t, err)
+
+	c.Set("a", b)
+	assert.Equal(t, time.Minute, server.ttl("a"))
+}
+
+func TestRedisCacheKeepsResponsesServedStale(t *testing.T) {
+	server := newFakeRedisServer(t)
+	c := NewRedisCache(server.addr())
+
+	response := http.Response{Header: make(http.Header), StatusCode: http.StatusOK}
+	response.Header.Set("Cache-Control", "max-age=1, stale-while-revalidate=600, stale-if-error=300")
+	response.Header.Set("Date", time.Now().Format(http.TimeFormat))
+	b, err := httputil.DumpResponse(&response, true)
+	assert.NoError(t, err)
+
+	c.Set("a", b)
+	ttl := server.ttl("a")
+	assert.LessOrEqual(t, ttl, 601*time.Second)
+	assert.Greater(t, ttl, 599*time.Second)
+
+	// a response with validators is kept to be freshened
+	response.Header.Set("Cache-Control", "max-age=1")
+	response.Header.Set("ETag", `"a"`)
+	b, err = httputil.DumpResponse(&response, true)
+	assert.NoError(t, err)
+	c.Set("a", b)
+	assert.Equal(t, time.Duration(0), server.ttl("a"))
+}
+
+func TestRedisCacheEntryExpiresOnServer(t *testing.T) {
+	server := newFakeRedisServer(t)
+	c := NewRedisCache(server.addr(), WithRedisDefaultTTL(time.Millisecond))
+
+	c.Set("a", []byte("hello world"))
+	time.Sleep(5 * time.Millisecond)
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+}
+
+func TestRedisCacheUnavailableServerIsMiss(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	c := NewRedisCache(addr, WithRedisDialTimeout(100*time.Millisecond))
+	c.Set("a", []byte("hello world"))
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+}
+
+func TestTransportWithRedisCache(t *testing.T) {
+	server := newFakeRedisServer(t)
+	cache := NewRedisCache(server.addr())
+
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Cache-Control", "max-age=100")
+	responseHeaders.Set("Date", time.Now().Format(http.TimeFormat))
+	transport := NewTransport(cache, &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte("hello world"))),
+			Header:     responseHeaders,
+		},
+	})
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+}
+
+// fakeRedisServer is an in-process server that understands the GET, SET and DEL commands.
+type fakeRedisServer struct {
+	t        *testing.T
+	listener net.Listener
+
+	mu       sync.Mutex
+	values   map[string][]byte
+	expiries map[string]time.Time
+	ttls     map[string]time.Duration
+	accepted int
+}
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &fakeRedisServer{
+		t:        t,
+		listener: l,
+		values:   make(map[string][]byte),
+		expiries: make(map[string]time.Time),
+		ttls:     make(map[string]time.Duration),
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedisServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRedisServer) ttl(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ttls[key]
+}
+
+func (s *fakeRedisServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+func (s *fakeRedisServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.accepted++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedisServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		command, err := readRESPReply(r)
+		if err != nil {
+			return
+		}
+		args := make([][]byte, 0, len(command.array))
+		for _, a := range command.array {
+			args = append(args, a.bulk)
+		}
+		s.execute(w, args)
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedisServer) execute(w *bufio.Writer, args [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(args) < 2 {
+		w.WriteString("-ERR wrong number of arguments\r\n")
+		return
+	}
+	key := string(args[1])
+	if expiry, ok := s.expiries[key]; ok && time.Now().After(expiry) {
+		delete(s.values, key)
+		delete(s.expiries, key)
+	}
+
+	switch strings.ToUpper(string(args[0])) {
+	case "GET":
+		v, ok := s.values[key]
+		if !ok {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+
+	case "SET":
+		s.values[key] = args[2]
+		delete(s.expiries, key)
+		s.ttls[key] = 0
+		if len(args) == 5 && strings.EqualFold(string(args[3]), "PX") {
+			ms, err := strconv.Atoi(string(args[4]))
+			assert.NoError(s.t, err)
+			s.ttls[key] = time.Duration(ms) * time.Millisecond
+			s.expiries[key] = time.Now().Add(s.ttls[key])
+		}
+		w.WriteString("+OK\r\n")
+
+	case "DEL":
+		_, ok := s.values[key]
+		delete(s.values, key)
+		delete(s.expiries, key)
+		if ok {
+			w.WriteString(":1\r\n")
+			return
+		}
+		w.WriteString(":0\r\n")
+
+	default:
+		w.WriteString("-ERR unknown command\r\n")
+	}
+}
+
+func TestTransportWithRedisCacheExpiresWithSharedLifetime(t *testing.T) {
+	server := newFakeRedisServer(t)
+	cache := NewRedisCache(server.addr())
+
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Cache-Control", "s-maxage=600, max-age=10")
+	responseHeaders.Set("Date", time.Now().Format(http.TimeFormat))
+	transport := NewTransport(cache, &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte("hello world"))),
+			Header:     responseHeaders,
+		},
+	}, SharedCache(true))
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	assert.Greater(t, server.ttl(buildCacheKey(r).String()), 590*time.Second)
+}
+
+func TestTransportWithRedisCacheKeepsResponsesForStaleIfError(t *testing.T) {
+	server := newFakeRedisServer(t)
+	cache := NewRedisCache(server.addr())
+
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Cache-Control", "max-age=1")
+	responseHeaders.Set("Date", time.Now().Format(http.TimeFormat))
+	transport := NewTransport(cache, &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte("hello world"))),
+			Header:     responseHeaders,
+		},
+	}, WithStaleIfError(10*time.Minute))
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	assert.Greater(t, server.ttl(buildCacheKey(r).String()), 590*time.Second)
+}
@@ -0,0 +1,65 @@
+package webcache
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// defaultCacheableStatusCodes returns the status codes whose responses are stored by default,
+// the status codes that are heuristically cacheable.
+// https://www.rfc-editor.org/rfc/rfc9110#section-15.1
+func defaultCacheableStatusCodes() map[int]bool {
+	codes := make(map[int]bool, len(heuristicallyCacheableStatusCodes))
+	for code := range heuristicallyCacheableStatusCodes {
+		codes[code] = true
+	}
+	return codes
+}
+
+// canStoreMethod reports whether the response to a request with the method can be stored.
+// GET and HEAD responses are cacheable, a POST response only when it has an explicit expiration and its
+// Content-Location is the target URI, it is then stored as the response to a GET of that URI.
+// https://www.rfc-editor.org/rfc/rfc9110#section-9.2.3
+func canStoreMethod(r *http.Request, response *http.Response, hasExplicitExpiration bool) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		// https://www.rfc-editor.org/rfc/rfc9110#section-9.3.3
+		return hasExplicitExpiration && isContentLocationOf(r, response)
+	default:
+		return false
+	}
+}
+
+// isContentLocationOf reports whether the Content-Location of the response is the target URI of the request.
+func isContentLocationOf(r *http.Request, response *http.Response) bool {
+	v := response.Header.Get("Content-Location")
+	if v == "" {
+		return false
+	}
+	ref, err := url.Parse(v)
+	if err != nil {
+		return false
+	}
+	return r.URL.ResolveReference(ref).String() == r.URL.String()
+}
+
+// storageRequest returns the request the response is stored for.
+// A POST response is stored as the response to a GET of the same URI.
+func storageRequest(r *http.Request) *http.Request {
+	if r.Method != http.MethodPost {
+		return r
+	}
+	return getRequest(r)
+}
+
+// getRequest returns a GET request for the target URI of the request, with the same header fields.
+func getRequest(r *http.Request) *http.Request {
+	get := r.Clone(r.Context())
+	get.Method = http.MethodGet
+	get.Body = nil
+	get.GetBody = nil
+	get.ContentLength = 0
+	return get
+}
@@ -0,0 +1,142 @@
+package webcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanStoreMethod(t *testing.T) {
+	response := &http.Response{Header: make(http.Header)}
+	newRequest := func(method string) *http.Request {
+		r, err := http.NewRequest(method, "http://example.com/items/1", nil)
+		assert.NoError(t, err)
+		return r
+	}
+
+	assert.True(t, canStoreMethod(newRequest(http.MethodGet), response, false))
+	assert.True(t, canStoreMethod(newRequest(http.MethodHead), response, false))
+	assert.False(t, canStoreMethod(newRequest(http.MethodPut), response, true))
+	assert.False(t, canStoreMethod(newRequest(http.MethodPost), response, true))
+
+	response.Header.Set("Content-Location", "/items/2")
+	assert.False(t, canStoreMethod(newRequest(http.MethodPost), response, true))
+
+	response.Header.Set("Content-Location", "/items/1")
+	assert.False(t, canStoreMethod(newRequest(http.MethodPost), response, false))
+	assert.True(t, canStoreMethod(newRequest(http.MethodPost), response, true))
+}
+
+func TestStorageRequest(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPost, "http://example.com/items/1", strings.NewReader("body"))
+	assert.NoError(t, err)
+	r.Header.Set("Accept", "application/json")
+
+	get := storageRequest(r)
+	assert.Equal(t, http.MethodGet, get.Method)
+	assert.Nil(t, get.Body)
+	assert.Equal(t, "application/json", get.Header.Get("Accept"))
+	assert.Equal(t, http.MethodPost, r.Method)
+
+	r.Method = http.MethodGet
+	assert.Same(t, r, storageRequest(r))
+}
+
+type statusOrigin struct {
+	status  int
+	headers map[string]string
+}
+
+func (o statusOrigin) RoundTrip(r *http.Request) (*http.Response, error) {
+	header := make(http.Header)
+	header.Set("Date", time.Now().Format(http.TimeFormat))
+	for k, v := range o.headers {
+		header.Set(k, v)
+	}
+	return &http.Response{
+		StatusCode: o.status,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader([]byte("body"))),
+	}, nil
+}
+
+func TestRoundTripStoresCacheableStatusCodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		opts   []TransportOption
+		stored bool
+	}{
+		{name: "ok", status: http.StatusOK, stored: true},
+		{name: "not found", status: http.StatusNotFound, stored: true},
+		{name: "permanent redirect", status: http.StatusPermanentRedirect, stored: true},
+		{name: "found", status: http.StatusFound},
+		{name: "internal server error", status: http.StatusInternalServerError},
+		{name: "extended", status: http.StatusFound, opts: []TransportOption{WithCacheableStatusCodes(http.StatusFound)}, stored: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := statusOrigin{status: tt.status, headers: map[string]string{"Cache-Control": "max-age=60"}}
+			transport := NewTransport(NewCache(), origin, tt.opts...)
+			r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			assert.NoError(t, err)
+			_, err = roundTripAndRead(t, transport, r)
+			assert.NoError(t, err)
+
+			_, ok := transport.cache.Get(r)
+			assert.Equal(t, tt.stored, ok)
+		})
+	}
+}
+
+func TestRoundTripStoresPostResponseForGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		stored  bool
+	}{
+		{name: "content location and max-age", headers: map[string]string{"Cache-Control": "max-age=60", "Content-Location": "/items/1"}, stored: true},
+		{name: "no content location", headers: map[string]string{"Cache-Control": "max-age=60"}},
+		{name: "other content location", headers: map[string]string{"Cache-Control": "max-age=60", "Content-Location": "/items/2"}},
+		{name: "no explicit expiration", headers: map[string]string{"Content-Location": "/items/1", "Last-Modified": time.Now().Add(-time.Hour).Format(http.TimeFormat)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := NewTransport(NewCache(), statusOrigin{status: http.StatusOK, headers: tt.headers})
+			r, err := http.NewRequest(http.MethodPost, "http://example.com/items/1", strings.NewReader("item"))
+			assert.NoError(t, err)
+			_, err = roundTripAndRead(t, transport, r)
+			assert.NoError(t, err)
+
+			_, ok := transport.cache.Get(r)
+			assert.False(t, ok)
+
+			get, err := http.NewRequest(http.MethodGet, "http://example.com/items/1", nil)
+			assert.NoError(t, err)
+			_, ok = transport.cache.Get(get)
+			assert.Equal(t, tt.stored, ok)
+		})
+	}
+}
+
+func TestRoundTripDoesNotStoreOtherMethods(t *testing.T) {
+	origin := statusOrigin{status: http.StatusOK, headers: map[string]string{"Cache-Control": "max-age=60", "Content-Location": "/items/1"}}
+	transport := NewTransport(NewCache(), origin)
+	for _, method := range []string{http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions} {
+		r, err := http.NewRequest(method, "http://example.com/items/1", nil)
+		assert.NoError(t, err)
+		_, err = roundTripAndRead(t, transport, r)
+		assert.NoError(t, err)
+
+		_, ok := transport.cache.Get(r)
+		assert.False(t, ok, method)
+		r.Method = http.MethodGet
+		_, ok = transport.cache.Get(r)
+		assert.False(t, ok, method)
+	}
+}
@@ -0,0 +1,120 @@
+package webcache
+
+import (
+	"time"
+)
+
+// cacheTier is one level of a tiered cache, with its own bounds.
+type cacheTier struct {
+	cache Cache[string, []byte]
+	// maxEntrySize is the largest value stored in the tier, zero means no limit.
+	maxEntrySize int
+	// maxTTL is the longest time an entry stays in the tier, zero means no limit.
+	maxTTL time.Duration
+}
+
+func (t cacheTier) set(key string, value []byte, ttl time.Duration, clock Clock) {
+	// the value does not fit the tier, an older value must not be served in its place
+	if t.maxEntrySize > 0 && len(value) > t.maxEntrySize {
+		t.cache.Delete(key)
+		return
+	}
+
+	// without a ttl, the entry expires as the backends do on their own, when the stored response can no longer be served
+	if t.maxTTL > 0 && ttl <= 0 {
+		ttl = storedResponseTTL(value, clock, 0)
+	}
+	if t.maxTTL > 0 && (ttl <= 0 || ttl > t.maxTTL) {
+		ttl = t.maxTTL
+	}
+
+	if ttl > 0 {
+		if c, ok := t.cache.(ExpiringCache[string, []byte]); ok {
+			c.SetWithTTL(key, value, ttl)
+			return
+		}
+	}
+	t.cache.Set(key, value)
+}
+
+type tieredCache struct {
+	l1    cacheTier
+	l2    cacheTier
+	clock Clock
+}
+
+type TieredCacheOption func(*tieredCache)
+
+// WithL1MaxEntrySize sets the largest value kept in the first tier.
+// Larger values are only stored in the second tier.
+func WithL1MaxEntrySize(n int) TieredCacheOption {
+	return func(c *tieredCache) {
+		c.l1.maxEntrySize = n
+	}
+}
+
+// WithL1MaxTTL caps how long an entry stays in the first tier.
+func WithL1MaxTTL(d time.Duration) TieredCacheOption {
+	return func(c *tieredCache) {
+		c.l1.maxTTL = d
+	}
+}
+
+// WithL2MaxEntrySize sets the largest value kept in the second tier.
+func WithL2MaxEntrySize(n int) TieredCacheOption {
+	return func(c *tieredCache) {
+		c.l2.maxEntrySize = n
+	}
+}
+
+// WithL2MaxTTL caps how long an entry stays in the second tier.
+func WithL2MaxTTL(d time.Duration) TieredCacheOption {
+	return func(c *tieredCache) {
+		c.l2.maxTTL = d
+	}
+}
+
+// NewTieredCache returns a Cache that looks up entries in l1 first and then in l2,
+// filling l1 on an l2 hit. Writes and deletes go to both tiers.
+// Typically l1 is a small in-process cache and l2 a slower shared one.
+// The TTL caps are enforced by tiers that implement ExpiringCache.
+func NewTieredCache(l1, l2 Cache[string, []byte], opts ...TieredCacheOption) Cache[string, []byte] {
+	c := &tieredCache{
+		l1:    cacheTier{cache: l1},
+		l2:    cacheTier{cache: l2},
+		clock: NewClock(),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+func (c *tieredCache) Get(key string) ([]byte, bool) {
+	if v, ok := c.l1.cache.Get(key); ok {
+		return v, true
+	}
+
+	v, ok := c.l2.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	c.l1.set(key, v, 0, c.clock)
+	return v, true
+}
+
+func (c *tieredCache) Set(key string, value []byte) {
+	c.SetWithTTL(key, value, 0)
+}
+
+func (c *tieredCache) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	// the shared tier is written first, so that other processes never miss an entry
+	// that is already served from this one
+	c.l2.set(key, value, ttl, c.clock)
+	c.l1.set(key, value, ttl, c.clock)
+}
+
+func (c *tieredCache) Delete(key string) {
+	c.l2.cache.Delete(key)
+	c.l1.cache.Delete(key)
+}
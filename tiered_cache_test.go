@@ -0,0 +1,133 @@
+package webcache
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTieredCache(t *testing.T) {
+	l1, l2 := NewCache(), NewCache()
+	c := NewTieredCache(l1, l2)
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	c.Set("a", []byte("hello world"))
+	_, ok = l1.Get("a")
+	assert.True(t, ok)
+	_, ok = l2.Get("a")
+	assert.True(t, ok)
+
+	c.Delete("a")
+	_, ok = l1.Get("a")
+	assert.False(t, ok)
+	_, ok = l2.Get("a")
+	assert.False(t, ok)
+}
+
+func TestTieredCacheFillsL1OnL2Hit(t *testing.T) {
+	l1, l2 := NewCache(), NewCache()
+	c := NewTieredCache(l1, l2)
+
+	l2.Set("a", []byte("hello world"))
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), v)
+
+	v, ok = l1.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), v)
+}
+
+func TestTieredCacheMaxEntrySize(t *testing.T) {
+	l1, l2 := NewCache(), NewCache()
+	c := NewTieredCache(l1, l2, WithL1MaxEntrySize(4), WithL2MaxEntrySize(8))
+
+	c.Set("a", []byte("1234"))
+	c.Set("a", []byte("123456"))
+	_, ok := l1.Get("a")
+	assert.False(t, ok)
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("123456"), v)
+
+	// an L2 hit that does not fit L1 is not promoted
+	_, ok = l1.Get("a")
+	assert.False(t, ok)
+
+	c.Set("a", []byte("123456789"))
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+}
+
+func TestTieredCacheMaxTTL(t *testing.T) {
+	clock := &mockClock{now: time.Now()}
+	l1 := &cache{clock: clock}
+	l2 := NewLRUCache(0, 0).(*lruCache)
+	l2.clock = clock
+	c := NewTieredCache(l1, l2, WithL1MaxTTL(time.Minute), WithL2MaxTTL(time.Hour))
+
+	c.Set("a", []byte("hello world"))
+	clock.Advance(2 * time.Minute)
+	_, ok := l1.Get("a")
+	assert.False(t, ok)
+
+	// the entry is refilled from L2 with a fresh L1 cap
+	_, ok = c.Get("a")
+	assert.True(t, ok)
+	clock.Advance(30 * time.Second)
+	_, ok = l1.Get("a")
+	assert.True(t, ok)
+
+	clock.Advance(time.Hour)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+
+	// an explicit ttl is capped by each tier
+	c.(ExpiringCache[string, []byte]).SetWithTTL("b", []byte("hello world"), 30*time.Second)
+	clock.Advance(45 * time.Second)
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+}
+
+func TestTieredCacheMaxTTLCapsFreshnessLifetime(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	l1 := &cache{clock: clock}
+	l2 := &cache{clock: clock}
+	c := NewTieredCache(l1, l2, WithL1MaxTTL(time.Minute), WithL2MaxTTL(time.Hour)).(*tieredCache)
+	c.clock = clock
+
+	response := http.Response{Header: make(http.Header), StatusCode: http.StatusOK}
+	response.Header.Set("Cache-Control", "max-age=600")
+	response.Header.Set("Date", clock.Now().Format(http.TimeFormat))
+	b, err := httputil.DumpResponse(&response, true)
+	assert.NoError(t, err)
+	c.Set("a", b)
+
+	// the first tier keeps the entry for its cap, the second one for the freshness lifetime
+	clock.Advance(2 * time.Minute)
+	_, ok := l1.Get("a")
+	assert.False(t, ok)
+	_, ok = l2.Get("a")
+	assert.True(t, ok)
+	clock.Advance(9 * time.Minute)
+	_, ok = l2.Get("a")
+	assert.False(t, ok)
+
+	// a response served stale is kept until its stale-if-error window ends
+	response.Header.Set("Cache-Control", "max-age=60, stale-if-error=600")
+	response.Header.Set("Date", clock.Now().Format(http.TimeFormat))
+	b, err = httputil.DumpResponse(&response, true)
+	assert.NoError(t, err)
+	c.Set("b", b)
+	clock.Advance(5 * time.Minute)
+	_, ok = l2.Get("b")
+	assert.True(t, ok)
+	clock.Advance(10 * time.Minute)
+	_, ok = l2.Get("b")
+	assert.False(t, ok)
+}
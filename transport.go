@@ -2,7 +2,11 @@ package webcache
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type Transport struct {
@@ -10,8 +14,31 @@ type Transport struct {
 	cache            HTTPCache
 	rt               http.RoundTripper
 	freshnessChecker freshnessChecker
+	freshnessPolicy  freshnessPolicy
 
 	shouldCachePrivateResponses bool
+	// cacheableStatusCodes are the status codes of the responses that can be stored
+	cacheableStatusCodes map[int]bool
+	// cacheName identifies the cache in the Cache-Status header
+	cacheName string
+	// xCacheHeader keeps the X-Cache header on responses served from the cache
+	xCacheHeader bool
+	// maxBufferSize bounds the bodies held in memory to be stored, when the cache does not stream
+	maxBufferSize int
+
+	// ctx is canceled when the transport is closed, it bounds the background revalidations
+	ctx    context.Context
+	cancel context.CancelFunc
+	// mu guards revalidating and closed
+	mu           sync.Mutex
+	revalidating map[string]bool
+	closed       bool
+	wg           sync.WaitGroup
+
+	// collapser collapses the concurrent requests for the same key into one request to the origin
+	collapser collapser
+	// collapseTimeout bounds how long collapsed requests wait for a streamed response to be stored
+	collapseTimeout time.Duration
 }
 
 type TransportOption func(*Transport)
@@ -28,58 +55,299 @@ func CachePrivateResponse(v bool) TransportOption {
 	}
 }
 
+// SharedCache makes the transport behave as a cache shared between users, such as a proxy.
+// A shared cache gives precedence to s-maxage, honours proxy-revalidate, never stores private
+// responses, and only stores responses to authenticated requests that explicitly allow it.
+// https://www.rfc-editor.org/rfc/rfc9111#section-1
+func SharedCache(v bool) TransportOption {
+	return func(t *Transport) {
+		t.freshnessPolicy.shared = v
+	}
+}
+
+// WithHeuristicFraction sets the fraction of the time since the Last-Modified date of a response
+// that is used as its freshness lifetime, when the response has no explicit expiration.
+// It defaults to 0.1.
+func WithHeuristicFraction(f float64) TransportOption {
+	return func(t *Transport) {
+		t.freshnessPolicy.heuristicFraction = f
+	}
+}
+
+// WithMaxHeuristicFreshness caps the heuristic freshness lifetime, it defaults to 24 hours.
+func WithMaxHeuristicFreshness(d time.Duration) TransportOption {
+	return func(t *Transport) {
+		t.freshnessPolicy.maxHeuristicLifetime = d
+	}
+}
+
+// WithStaleIfError sets how long past its expiration a response can be served when its validation fails,
+// for responses and requests without a stale-if-error directive. It defaults to zero, stale responses
+// are then only served on errors when a directive allows it.
+// https://www.rfc-editor.org/rfc/rfc5861#section-4
+func WithStaleIfError(d time.Duration) TransportOption {
+	return func(t *Transport) {
+		t.freshnessPolicy.staleIfError = d
+	}
+}
+
+// WithCacheableStatusCodes adds status codes to the ones whose responses can be stored.
+// By default, only the responses with a heuristically cacheable status code are stored:
+// 200, 203, 204, 206, 300, 301, 308, 404, 405, 410, 414 and 501.
+func WithCacheableStatusCodes(codes ...int) TransportOption {
+	return func(t *Transport) {
+		for _, code := range codes {
+			t.cacheableStatusCodes[code] = true
+		}
+	}
+}
+
+// WithCacheName sets the name of the cache in the Cache-Status header, it defaults to "webcache".
+// The stored parameter is only sent for the responses that are stored by the time they are returned: the
+// responses without body, and the stored responses freshened in place by a 304 response. A response with a
+// body is stored once its client reads it, after Cache-Status is sent, and is never reported as stored.
+// https://www.rfc-editor.org/rfc/rfc9211#section-2
+func WithCacheName(name string) TransportOption {
+	return func(t *Transport) {
+		t.cacheName = name
+	}
+}
+
+// XCacheHeader adds "X-Cache: HIT" to the responses served from the cache, along with Cache-Status,
+// for clients that still rely on it.
+func XCacheHeader(v bool) TransportOption {
+	return func(t *Transport) {
+		t.xCacheHeader = v
+	}
+}
+
+// WithMaxBufferSize sets the largest body held in memory to be stored, when the cache does not implement
+// StreamingCache. Responses with larger bodies are not stored. It defaults to 32MB, zero or less means no limit.
+func WithMaxBufferSize(n int) TransportOption {
+	return func(t *Transport) {
+		t.maxBufferSize = n
+	}
+}
+
+// WithCollapseTimeout sets how long concurrent requests for the same key wait for the response of the first one
+// to be stored, once its body is read by its client. One of them is then sent to the origin, and the others wait
+// for its response in turn. It defaults to one second.
+func WithCollapseTimeout(d time.Duration) TransportOption {
+	return func(t *Transport) {
+		t.collapseTimeout = d
+	}
+}
+
 // NewRoundTripper
 func NewTransport(cache Cache[string, []byte], rt http.RoundTripper, opts ...TransportOption) *Transport {
 	t := &Transport{
-		cache: NewHTTPCache(cache),
-		rt:    rt,
-		clock: NewClock(),
+		rt:              rt,
+		clock:           NewClock(),
+		freshnessPolicy: defaultFreshnessPolicy(),
+		revalidating:    make(map[string]bool),
+
+		cacheableStatusCodes: defaultCacheableStatusCodes(),
+		cacheName:            defaultCacheName,
+		maxBufferSize:        defaultMaxBufferSize,
+		collapseTimeout:      defaultCollapseTimeout,
 	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
 	for _, o := range opts {
 		o(t)
 	}
-	t.freshnessChecker = newFreshnerChecker(t.clock)
+	t.cache = NewHTTPCache(cache, WithHTTPCacheMaxBufferSize(t.maxBufferSize))
+	t.freshnessChecker = newFreshnerChecker(t.clock, t.freshnessPolicy)
 	return t
 }
 
 func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var status cacheStatus
+	response, err := t.roundTrip(r, &status)
+	if err != nil {
+		return nil, err
+	}
+	return t.withCacheStatus(response, status), nil
+}
+
+func (t *Transport) roundTrip(r *http.Request, status *cacheStatus) (*http.Response, error) {
+	// an unsafe request always reaches the origin, and invalidates what is stored for its URI
+	if !isSafeMethod(r.Method) {
+		status.fwd = fwdMethod
+		requestTime := t.clock.Now()
+		response, err := t.rt.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+		responseTime := t.clock.Now()
+		status.fwdStatus = response.StatusCode
+
+		t.invalidate(r, response)
+		if t.shouldStore(r, response) {
+			status.storing = true
+			status.stored = t.store(storageRequest(r), response, requestTime, responseTime)
+		}
+		return response, nil
+	}
+
+	// a HEAD request is answered by the stored response to a GET, if there is a fresh one
+	if r.Method == http.MethodHead {
+		if response, ok := t.headFromStoredGet(r); ok {
+			status.hit = true
+			return serveConditional(r, response), nil
+		}
+	}
+
 	// check if we have this request in the cache
 	ctx := r.Context()
 	if response, ok := t.cache.Get(r); ok {
-		return t.roundTripWithCachedResponse(ctx, response, r)
+		response, err := t.roundTripWithCachedResponse(ctx, response, r, status)
+		if err != nil {
+			return nil, err
+		}
+		return serveFromCache(r, response, status)
 	}
 
+	// the client does not want the request to reach the origin
+	if newCacheControl(r.Header).OnlyIfCached() {
+		return gatewayTimeoutResponse(r), nil
+	}
+
+	response, err := t.collapse(r, status, func() (*http.Response, error) {
+		return t.forward(r, status)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serveFromCache(r, response, status)
+}
+
+// hasVariantIndex reports whether the responses stored for the target URI of the request vary on request
+// header fields, so that a miss is a vary-miss.
+func (t *Transport) hasVariantIndex(r *http.Request) bool {
+	c, ok := t.cache.(variantIndexer)
+	return ok && c.hasVariantIndex(r)
+}
+
+// forward sends the request that missed the cache to the origin, and stores the response.
+func (t *Transport) forward(r *http.Request, status *cacheStatus) (*http.Response, error) {
+	status.fwd = fwdURIMiss
+	if t.hasVariantIndex(r) {
+		status.fwd = fwdVaryMiss
+	}
+	requestTime := t.clock.Now()
 	response, err := t.rt.RoundTrip(r)
 	if err != nil {
 		return nil, err
 	}
-	cacheControl := newCacheControl(response.Header)
-	if !cacheControl.IsPresent() {
+	responseTime := t.clock.Now()
+	status.fwdStatus = response.StatusCode
+
+	if r.Method == http.MethodHead {
+		t.updateFromHead(r, response, requestTime, responseTime)
+	}
+	if t.shouldStore(r, response) {
+		status.storing = true
+		status.stored = t.store(r, response, requestTime, responseTime)
+	}
+	return response, nil
+}
+
+// serveFromCache answers the conditional and range requests of the client from a response
+// served from the cache, other responses are returned unchanged.
+func serveFromCache(r *http.Request, response *http.Response, status *cacheStatus) (*http.Response, error) {
+	if !status.fromCache() {
 		return response, nil
 	}
+	// the preconditions of the client are evaluated before its range, against the stored response
+	if response = serveConditional(r, response); response.StatusCode == http.StatusNotModified {
+		return response, nil
+	}
+	// a range request is answered from the stored complete response
+	return serveRange(r, response)
+}
+
+// withCacheStatus adds the Cache-Status header to the response, with the remaining freshness lifetime
+// of the responses that are served from the cache or stored.
+// A response is only a hit when the request was not forwarded, a stored response served after
+// its validation carries the reason of the forward instead.
+// X-Cache is only added when the transport is configured with XCacheHeader, an X-Cache header of the origin
+// is left as is.
+func (t *Transport) withCacheStatus(response *http.Response, status cacheStatus) *http.Response {
+	if status.fromCache() || status.storing {
+		status.ttl, status.hasTTL = t.ttl(response.Header)
+	}
+	response.Header = withCacheStatusHeader(response.Header, t.cacheName, status)
+	if status.fromCache() && t.xCacheHeader {
+		response.Header = withCacheHitHeader(response.Header)
+	}
+	return response
+}
+
+// ttl returns the remaining freshness lifetime of a response that is served.
+// The Age of a response served from the cache is its current age.
+func (t *Transport) ttl(header http.Header) (time.Duration, bool) {
+	cacheControl := newCacheControl(header)
+	lifetime, ok := t.freshnessPolicy.lifetime(header, cacheControl)
+	if !ok {
+		return 0, false
+	}
+	if age, err := ageFromHeader(header); err == nil {
+		return lifetime - time.Duration(age)*time.Second, true
+	}
+	return lifetime - currentAge(header, t.clock), true
+}
+
+// shouldStore reports whether the response to the request can be stored.
+// https://www.rfc-editor.org/rfc/rfc9111#section-3
+func (t *Transport) shouldStore(r *http.Request, response *http.Response) bool {
+	cacheControl := newCacheControl(response.Header)
+	hasExplicitExpiration := t.freshnessPolicy.hasExplicitExpiration(response.Header, cacheControl)
+
+	if !canStoreMethod(r, response, hasExplicitExpiration) || !t.cacheableStatusCodes[response.StatusCode] {
+		return false
+	}
+
+	// a response is reused either until its explicit expiration,
+	// or for a heuristic lifetime when its status code allows it
+	if !hasExplicitExpiration && !canUseHeuristicFreshness(response.StatusCode, response.Header, cacheControl) {
+		return false
+	}
 
 	// The no-store response directive indicates that any caches of any kind (private or shared) should not store this response.
-	if cacheControl.NoStore() {
-		return response, nil
+	// The no-store request directive asks the same for the response to this request.
+	if cacheControl.NoStore() || newCacheControl(r.Header).NoStore() {
+		return false
 	}
 
-	if cacheControl.NoCache() || cacheControl.NoCacheEquivalent() {
-		return response, nil
+	if cacheControl.NoCache() || t.freshnessPolicy.noCacheEquivalent(response.Header, cacheControl) {
+		return false
 	}
 
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Caching#public_vs._private_caches
 	// The private response directive indicates that the response can be stored only in a private cache
 	// (e.g. local caches in browsers).
-	if !t.shouldCachePrivateResponses && cacheControl.Private() {
-		return response, nil
+	if (t.freshnessPolicy.shared || !t.shouldCachePrivateResponses) && cacheControl.Private() {
+		return false
 	}
 
-	t.cache.Set(r, response)
-	return response, nil
+	// A shared cache must not reuse a response to an authenticated request for other users,
+	// unless the response explicitly allows it.
+	// https://www.rfc-editor.org/rfc/rfc9111#section-3.5
+	if t.freshnessPolicy.shared && r.Header.Get("Authorization") != "" && !allowsAuthenticatedStorage(cacheControl) {
+		return false
+	}
+
+	// a partial response is not stored, it would take the place of the complete response
+	if response.StatusCode == http.StatusPartialContent {
+		return false
+	}
+
+	return true
 }
 
-func (t *Transport) roundTripWithCachedResponse(ctx context.Context, response *http.Response, r *http.Request) (*http.Response, error) {
+func (t *Transport) roundTripWithCachedResponse(ctx context.Context, response *http.Response, r *http.Request, status *cacheStatus) (*http.Response, error) {
 	cacheControl := newCacheControl(response.Header)
+	requestCacheControl := newCacheControl(r.Header)
 
 	// we check if the response is still fresh, if it is, we return it
 	freshness, err := t.freshnessChecker.Freshness(ctx, response.Header, cacheControl)
@@ -87,35 +355,277 @@ func (t *Transport) roundTripWithCachedResponse(ctx context.Context, response *h
 		return nil, err
 	}
 
-	switch freshness {
+	// the client may ask for a fresher response, or accept a stale one
+	requested := t.freshnessPolicy.requestedFreshness(freshness, response.Header, cacheControl, requestCacheControl, t.clock)
+	if requested != FreshnessFresh && requestCacheControl.OnlyIfCached() {
+		response.Body.Close()
+		return gatewayTimeoutResponse(r), nil
+	}
+
+	switch requested {
 	case FreshnessFresh:
-		response.Header = withCacheHitHeader(response.Header)
-		return response, nil
+		status.hit = true
+		if freshness == FreshnessStale {
+			return t.serveStale(response), nil
+		}
+		return t.serveStored(response), nil
 
 	case FreshnessStale:
-		// if the response is stale, we check if we can validate it
-		validator := newResponseValidator(t.rt)
-		response, err := validator.Validate(response, r)
+		// within its stale-while-revalidate window, the stale response is served right away
+		// and validated in the background
+		if freshness == FreshnessStale && t.freshnessPolicy.canRevalidateInBackground(response.Header, cacheControl, requestCacheControl, t.clock) && t.revalidateInBackground(r) {
+			status.hit = true
+			return t.serveStale(response), nil
+		}
+
+		// concurrent validations of the same stale response are collapsed into one
+		revalidated := false
+		collapsed, err := t.collapse(r, status, func() (*http.Response, error) {
+			revalidated = true
+			status.fwd = fwdStale
+			if freshness == FreshnessFresh {
+				status.fwd = fwdRequest
+			}
+			return t.revalidate(r, response, cacheControl, status)
+		})
+		if !revalidated {
+			// the request was answered with the response stored by the validation it was collapsed with
+			response.Body.Close()
+		}
+		return collapsed, err
+
+	default:
+		response.Body.Close()
+		status.fwd = fwdMiss
+		response, err := t.rt.RoundTrip(r)
 		if err != nil {
 			return nil, err
 		}
+		status.fwdStatus = response.StatusCode
+		return response, nil
+	}
+}
 
-		// if caching is not allowed, we delete the response from the cache
-		if cacheControl.NoStore() {
-			t.cache.Delete(r)
-			return response, nil
+// revalidate validates the stale response with the origin, and stores the response of the origin if it changed.
+// When the origin fails, the stale response is served if stale-if-error allows it.
+func (t *Transport) revalidate(r *http.Request, response *http.Response, cacheControl CacheControl, status *cacheStatus) (*http.Response, error) {
+	stale := response
+	canServeStaleIfError := t.freshnessPolicy.canServeStaleIfError(stale.Header, cacheControl, newCacheControl(r.Header), t.clock)
+
+	validator := newConditionalValidator(t.rt, t.cache)
+	requestTime := t.clock.Now()
+	response, freshened, err := validator.validate(response, r)
+	if err != nil {
+		if canServeStaleIfError && r.Context().Err() == nil {
+			status.served = true
+			return t.serveStaleIfError(stale), nil
 		}
+		stale.Body.Close()
+		return nil, err
+	}
+	responseTime := t.clock.Now()
+
+	status.fwdStatus = response.StatusCode
+	if isServerError(response.StatusCode) && canServeStaleIfError {
+		_, _ = io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		status.served = true
+		return t.serveStaleIfError(stale), nil
+	}
+
+	// the stale response is only served when the validator freshened it, it closed it if it selected another one
+	if !freshened {
+		stale.Body.Close()
+	}
 
-		// if the validator returned a cached response, we return it
-		if isCached(response) {
-			return response, nil
+	// if caching is not allowed, we delete the response from the cache
+	if cacheControl.NoStore() {
+		t.cache.Delete(r)
+	}
+
+	// if the validator returned the cached response, it was freshened by a 304 response and is stored again
+	if freshened {
+		status.fwdStatus = http.StatusNotModified
+		status.served = true
+		if !cacheControl.NoStore() && t.shouldStore(r, response) {
+			status.storing = true
+			status.stored = t.storeAgain(r, response, requestTime, responseTime)
 		}
+		return t.serveStored(response), nil
+	}
 
-		// otherwise, we cache the response and return it
-		t.cache.Set(r, response)
+	if cacheControl.NoStore() || !t.shouldStore(r, response) {
 		return response, nil
+	}
 
-	default:
-		return t.rt.RoundTrip(r)
+	// otherwise, we cache the response and return it
+	status.storing = true
+	status.stored = t.store(r, response, requestTime, responseTime)
+	return response, nil
+}
+
+// revalidateInBackground refreshes the stored response for the request, unless a revalidation
+// of the same key is already running. It reports false once the transport is closed.
+// The revalidation does not depend on the caller's context, it only stops when the transport is closed.
+func (t *Transport) revalidateInBackground(r *http.Request) bool {
+	key := buildCacheKey(r).String()
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return false
+	}
+	if t.revalidating[key] {
+		t.mu.Unlock()
+		return true
+	}
+	t.revalidating[key] = true
+	t.wg.Add(1)
+	t.mu.Unlock()
+
+	r = r.Clone(t.ctx)
+	go func() {
+		defer t.wg.Done()
+		defer func() {
+			t.mu.Lock()
+			delete(t.revalidating, key)
+			t.mu.Unlock()
+		}()
+
+		// the stale response served to the caller is not shared with the revalidation
+		response, ok := t.cache.Get(r)
+		if !ok {
+			return
+		}
+		response, err := t.revalidate(r, response, newCacheControl(response.Header), &cacheStatus{})
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+	}()
+	return true
+}
+
+// Close stops the background revalidations and waits for them to return.
+// The transport keeps serving requests, stale responses are then validated before they are served.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	t.cancel()
+	t.wg.Wait()
+	return nil
+}
+
+// store saves the response along with the times of the exchange that produced it,
+// which are needed to compute its age once it is served from the cache.
+// The fields named by qualified no-cache and private directives are not stored, the rest of the response
+// is reused without validation.
+// It reports whether the response is stored when it returns, which is only the case of a response without
+// body: others are stored once their body is read.
+func (t *Transport) store(r *http.Request, response *http.Response, requestTime, responseTime time.Time) bool {
+	header := response.Header
+	withoutBody := response.Body == nil || response.Body == http.NoBody
+	response.Header = t.storedHeader(header, requestTime, responseTime)
+	t.cache.Set(r, response)
+	response.Header = withoutInternalHeaders(header)
+	return withoutBody
+}
+
+// storedHeader returns the header of a response as it is stored, with the times of the exchange,
+// its freshness lifetime and how long it can be served stale.
+func (t *Transport) storedHeader(header http.Header, requestTime, responseTime time.Time) http.Header {
+	stored := withExchangeTimeHeaders(withoutHeaders(header, t.unreusableFields(header)), requestTime, responseTime)
+	cacheControl := newCacheControl(stored)
+	if lifetime, ok := t.freshnessPolicy.lifetime(stored, cacheControl); ok {
+		stored = withLifetimeHeader(stored, lifetime)
+	}
+	if staleLifetime := t.freshnessPolicy.staleLifetime(stored, cacheControl); staleLifetime > 0 {
+		stored = withStaleLifetimeHeader(stored, staleLifetime)
+	}
+	return stored
+}
+
+// storeAgain stores a response read from the cache with updated headers, and reports whether it is stored
+// when it returns. When the cache replaces the header of the stored response in place, its body is left as is.
+// Otherwise the response is stored as its body is read, as a response of the origin is.
+func (t *Transport) storeAgain(r *http.Request, response *http.Response, requestTime, responseTime time.Time) bool {
+	if c, ok := t.cache.(headerUpdater); ok {
+		header := response.Header
+		response.Header = t.storedHeader(header, requestTime, responseTime)
+		updated := c.updateHeader(r, response)
+		response.Header = withoutInternalHeaders(header)
+		if updated {
+			return true
+		}
+	}
+	return t.store(r, response, requestTime, responseTime)
+}
+
+// unreusableFields returns the header fields of the response that cannot be reused without validation.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.4
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.7
+func (t *Transport) unreusableFields(header http.Header) []string {
+	cacheControl := newCacheControl(header)
+	fields := cacheControl.NoCacheFields()
+	if t.freshnessPolicy.shared || !t.shouldCachePrivateResponses {
+		fields = append(fields, cacheControl.PrivateFields()...)
+	}
+	return fields
+}
+
+// serveStored prepares a stored response to be returned to the client, with its current age.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.1
+func (t *Transport) serveStored(response *http.Response) *http.Response {
+	age := currentAge(response.Header, t.clock)
+	response.Header = withoutInternalHeaders(withAgeHeader(response.Header, age))
+
+	// https://www.rfc-editor.org/rfc/rfc7234#section-4.2.2
+	if age > heuristicWarningAge && !t.freshnessPolicy.hasExplicitExpiration(response.Header, newCacheControl(response.Header)) {
+		response.Header = withWarningHeader(response.Header, 113, "Heuristic Expiration")
+	}
+	return response
+}
+
+// serveStale prepares a stored response that is served although it is stale.
+// https://www.rfc-editor.org/rfc/rfc7234#section-5.5.1
+func (t *Transport) serveStale(response *http.Response) *http.Response {
+	response = t.serveStored(response)
+	response.Header = withWarningHeader(response.Header, 110, "Response is Stale")
+	return response
+}
+
+// serveStaleIfError prepares a stored response that is served because its validation failed.
+// https://www.rfc-editor.org/rfc/rfc7234#section-5.5.2
+func (t *Transport) serveStaleIfError(response *http.Response) *http.Response {
+	response = t.serveStale(response)
+	response.Header = withWarningHeader(response.Header, 111, "Revalidation Failed")
+	return response
+}
+
+// gatewayTimeoutResponse is the response to a request with only-if-cached that cannot be served from the cache.
+// https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.7
+func gatewayTimeoutResponse(r *http.Request) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout)),
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    r,
+	}
+}
+
+// allowsAuthenticatedStorage reports whether a shared cache can store the response to a request with Authorization.
+// https://www.rfc-editor.org/rfc/rfc9111#section-3.5
+func allowsAuthenticatedStorage(cacheControl CacheControl) bool {
+	if cacheControl.Public() || cacheControl.MustRevalidate() {
+		return true
 	}
+	_, err := cacheControl.SMaxAge()
+	return err == nil
 }
@@ -2,9 +2,13 @@ package webcache
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httputil"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,7 +32,7 @@ func TestTransportIfRequestExistsInCache(t *testing.T) {
 	response, err := roundTripper.RoundTrip(r)
 	assert.NoError(t, err)
 	assert.Equal(t, response.StatusCode, http.StatusOK)
-	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.True(t, servedFromCache(response))
 }
 
 func TestTransportIfRequestIsStaleWithLastModified(t *testing.T) {
@@ -59,7 +63,7 @@ func TestTransportIfRequestIsStaleWithLastModified(t *testing.T) {
 
 	response, err := rt.RoundTrip(r)
 	assert.NoError(t, err)
-	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.True(t, servedFromCache(response))
 }
 
 func TestTransportIfRequestIsStaleWithEtag(t *testing.T) {
@@ -90,7 +94,7 @@ func TestTransportIfRequestIsStaleWithEtag(t *testing.T) {
 
 	response, err := rt.RoundTrip(r)
 	assert.NoError(t, err)
-	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.True(t, servedFromCache(response))
 }
 
 func TestTransportIfRequestIsStaleWithEtagChanged(t *testing.T) {
@@ -120,7 +124,7 @@ func TestTransportIfRequestIsStaleWithEtagChanged(t *testing.T) {
 	rt := NewTransport(cache, mockRt, WithClock(NewClock()))
 	response, err := rt.RoundTrip(r)
 	assert.NoError(t, err)
-	assert.Equal(t, "", response.Header.Get("X-Cache"))
+	assert.False(t, servedFromCache(response))
 }
 
 func TestTransportShouldNotCacheIfNoStoreCacheControlHeader(t *testing.T) {
@@ -151,7 +155,7 @@ func TestTransportShouldNotCacheIfNoStoreCacheControlHeader(t *testing.T) {
 
 	response, err := rt.RoundTrip(r)
 	assert.NoError(t, err)
-	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.True(t, servedFromCache(response))
 
 	// there should be no cache entry because of the no-store directive
 	_, ok := cache.Get(buildCacheKey(r).String())
@@ -169,9 +173,9 @@ func TestRoundTripNoCacheStorageIfNoCacheControl(t *testing.T) {
 			Body:       io.NopCloser(bytes.NewReader([]byte(""))),
 		},
 	})
-	response, err := transport.RoundTrip(r)
+	response, err := roundTripAndRead(t, transport, r)
 	assert.NoError(t, err)
-	assert.False(t, isCached(response))
+	assert.False(t, servedFromCache(response))
 	_, ok := cache.Get(buildCacheKey(r).String())
 	assert.False(t, ok)
 }
@@ -190,9 +194,9 @@ func TestRoundTripNoCacheStorageIfCacheControlWithNoStore(t *testing.T) {
 			Header:     responseHeaders,
 		},
 	})
-	response, err := transport.RoundTrip(r)
+	response, err := roundTripAndRead(t, transport, r)
 	assert.NoError(t, err)
-	assert.False(t, isCached(response))
+	assert.False(t, servedFromCache(response))
 	_, ok := cache.Get(buildCacheKey(r).String())
 	assert.False(t, ok)
 }
@@ -211,9 +215,9 @@ func TestRoundTripNoCacheStorageIfCacheControlWithNoCache(t *testing.T) {
 			Header:     responseHeaders,
 		},
 	})
-	response, err := transport.RoundTrip(r)
+	response, err := roundTripAndRead(t, transport, r)
 	assert.NoError(t, err)
-	assert.False(t, isCached(response))
+	assert.False(t, servedFromCache(response))
 	_, ok := cache.Get(buildCacheKey(r).String())
 	assert.False(t, ok)
 }
@@ -232,9 +236,9 @@ func TestRoundTripNoCacheStorageIfCacheControlWithNoCacheEquivalent(t *testing.T
 			Header:     responseHeaders,
 		},
 	})
-	response, err := transport.RoundTrip(r)
+	response, err := roundTripAndRead(t, transport, r)
 	assert.NoError(t, err)
-	assert.False(t, isCached(response))
+	assert.False(t, servedFromCache(response))
 	_, ok := cache.Get(buildCacheKey(r).String())
 	assert.False(t, ok)
 }
@@ -254,13 +258,779 @@ func TestRoundTripNoCacheStorageIfCacheControlWithMaxAge(t *testing.T) {
 			Header:     responseHeaders,
 		},
 	})
+	response, err := roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	assert.False(t, servedFromCache(response))
+	_, ok := cache.Get(buildCacheKey(r).String())
+	assert.True(t, ok)
+
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+}
+
+func TestRoundTripSelectsVariantFromResponseVary(t *testing.T) {
+	cache := NewCache()
+	origin := &varyingRoundTripper{}
+	transport := NewTransport(cache, origin)
+
+	english := newVaryRequest(t, "en-US")
+	french := newVaryRequest(t, "fr")
+
+	for i := 0; i < 2; i++ {
+		response, err := transport.RoundTrip(english)
+		assert.NoError(t, err)
+		body, err := io.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "content for en-US", string(body))
+
+		response, err = transport.RoundTrip(french)
+		assert.NoError(t, err)
+		body, err = io.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "content for fr", string(body))
+	}
+	assert.Equal(t, 2, origin.calls)
+}
+
+// varyingRoundTripper returns a response negotiated on Accept-Language.
+type varyingRoundTripper struct {
+	calls int
+}
+
+func (m *varyingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	m.calls++
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "max-age=100")
+	headers.Set("Date", time.Now().Format(http.TimeFormat))
+	headers.Set("Vary", "Accept-Language")
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     headers,
+		Body:       io.NopCloser(bytes.NewReader([]byte("content for " + r.Header.Get("Accept-Language")))),
+	}, nil
+}
+
+func TestRoundTripServesAgeHeader(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Cache-Control", "max-age=100")
+	responseHeaders.Set("Date", clock.Now().Add(-10*time.Second).Format(http.TimeFormat))
+	responseHeaders.Set("Age", "5")
+	cache := NewCache()
+	transport := NewTransport(cache, &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte(""))),
+			Header:     responseHeaders,
+		},
+	}, WithClock(clock))
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err := roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	assert.Empty(t, response.Header.Get(headerRequestTime))
+	assert.Empty(t, response.Header.Get(headerResponseTime))
+
+	clock.Advance(30 * time.Second)
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, "40", response.Header.Get("Age"))
+	assert.Empty(t, response.Header.Get(headerRequestTime))
+	assert.Empty(t, response.Header.Get(headerResponseTime))
+
+	// the time spent in the cache counts against the freshness lifetime
+	clock.Advance(60 * time.Second)
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.False(t, servedFromCache(response))
+}
+
+func TestRoundTripStoresResponsesWithOnlyLastModified(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Date", clock.Now().Format(http.TimeFormat))
+	responseHeaders.Set("Last-Modified", clock.Now().Add(-100*24*time.Hour).Format(http.TimeFormat))
+	cache := NewCache()
+	transport := NewTransport(cache, &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte(""))),
+			Header:     responseHeaders,
+		},
+	}, WithClock(clock), WithMaxHeuristicFreshness(48*time.Hour))
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+
+	clock.Advance(time.Hour)
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Empty(t, response.Header.Get("Warning"))
+
+	clock.Advance(24 * time.Hour)
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, `113 - "Heuristic Expiration"`, response.Header.Get("Warning"))
+}
+
+func TestRoundTripNoHeuristicStorageForUncacheableStatus(t *testing.T) {
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Date", time.Now().Format(http.TimeFormat))
+	responseHeaders.Set("Last-Modified", time.Now().Add(-24*time.Hour).Format(http.TimeFormat))
+	cache := NewCache()
+	transport := NewTransport(cache, &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       io.NopCloser(bytes.NewReader([]byte(""))),
+			Header:     responseHeaders,
+		},
+	})
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	_, ok := cache.Get(buildCacheKey(r).String())
+	assert.False(t, ok)
+}
+
+func TestSharedCacheStorage(t *testing.T) {
+	tests := []struct {
+		name          string
+		cacheControl  string
+		authorization bool
+		stored        bool
+	}{
+		{name: "public response", cacheControl: "max-age=100", stored: true},
+		{name: "private response", cacheControl: "max-age=100, private"},
+		{name: "authenticated request", cacheControl: "max-age=100", authorization: true},
+		{name: "authenticated request with public", cacheControl: "max-age=100, public", authorization: true, stored: true},
+		{name: "authenticated request with s-maxage", cacheControl: "s-maxage=100", authorization: true, stored: true},
+		{name: "authenticated request with must-revalidate", cacheControl: "max-age=100, must-revalidate", authorization: true, stored: true},
+		{name: "proxy-revalidate without lifetime", cacheControl: "max-age=0, proxy-revalidate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responseHeaders := make(http.Header)
+			responseHeaders.Set("Cache-Control", tt.cacheControl)
+			responseHeaders.Set("Date", time.Now().Format(http.TimeFormat))
+			cache := NewCache()
+			transport := NewTransport(cache, &mockRoundTripper{
+				response: &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewReader([]byte(""))),
+					Header:     responseHeaders,
+				},
+			}, SharedCache(true), CachePrivateResponse(true))
+
+			r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			assert.NoError(t, err)
+			if tt.authorization {
+				r.Header.Set("Authorization", "Bearer token")
+			}
+			_, err = roundTripAndRead(t, transport, r)
+			assert.NoError(t, err)
+			_, ok := cache.Get(buildCacheKey(r).String())
+			assert.Equal(t, tt.stored, ok)
+		})
+	}
+}
+
+func TestSharedCachePrefersSMaxAge(t *testing.T) {
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Cache-Control", "max-age=0, s-maxage=100")
+	responseHeaders.Set("Date", time.Now().Format(http.TimeFormat))
+	transport := NewTransport(NewCache(), &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte(""))),
+			Header:     responseHeaders,
+		},
+	}, SharedCache(true))
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+}
+
+func newRequestDirectivesTransport(t *testing.T, clock Clock) (*Transport, *mockRoundTripper) {
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Cache-Control", "max-age=60")
+	responseHeaders.Set("Date", clock.Now().Format(http.TimeFormat))
+	origin := &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte(""))),
+			Header:     responseHeaders,
+		},
+	}
+	transport := NewTransport(NewCache(), origin, WithClock(clock))
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	return transport, origin
+}
+
+func TestRoundTripRequestMaxStale(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	transport, origin := newRequestDirectivesTransport(t, clock)
+	clock.Advance(90 * time.Second)
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	r.Header.Set("Cache-Control", "max-stale=60")
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, `110 - "Response is Stale"`, response.Header.Get("Warning"))
+	assert.Equal(t, 1, origin.calls)
+
+	r.Header.Set("Cache-Control", "max-stale=10")
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.False(t, servedFromCache(response))
+	assert.Equal(t, 2, origin.calls)
+}
+
+func TestRoundTripRequestMinFreshAndNoCache(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	transport, origin := newRequestDirectivesTransport(t, clock)
+	clock.Advance(30 * time.Second)
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	r.Header.Set("Cache-Control", "min-fresh=10")
 	response, err := transport.RoundTrip(r)
 	assert.NoError(t, err)
-	assert.False(t, isCached(response))
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, 1, origin.calls)
+
+	r.Header.Set("Cache-Control", "min-fresh=40")
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.NoError(t, response.Body.Close())
+	assert.Equal(t, 2, origin.calls)
+
+	r.Header.Set("Cache-Control", "no-cache")
+	_, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, origin.calls)
+}
+
+func TestRoundTripRequestNoStore(t *testing.T) {
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Cache-Control", "max-age=60")
+	responseHeaders.Set("Date", time.Now().Format(http.TimeFormat))
+	cache := NewCache()
+	transport := NewTransport(cache, &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader([]byte(""))),
+			Header:     responseHeaders,
+		},
+	})
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	r.Header.Set("Cache-Control", "no-store")
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
 	_, ok := cache.Get(buildCacheKey(r).String())
+	assert.False(t, ok)
+}
+
+func TestRoundTripRequestOnlyIfCached(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	transport, origin := newRequestDirectivesTransport(t, clock)
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	r.Header.Set("Cache-Control", "only-if-cached")
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.True(t, servedFromCache(response))
+
+	// a stale response is not used
+	clock.Advance(2 * time.Minute)
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, response.StatusCode)
+
+	other, err := http.NewRequest(http.MethodGet, "http://example.com/other", nil)
+	assert.NoError(t, err)
+	other.Header.Set("Cache-Control", "only-if-cached")
+	response, err = transport.RoundTrip(other)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, response.StatusCode)
+	assert.Equal(t, 1, origin.calls)
+}
+
+// blockingRoundTripper holds every request until it is released or its context is done.
+type blockingRoundTripper struct {
+	release chan struct{}
+	header  http.Header
+	calls   atomic.Int32
+}
+
+func (b *blockingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	b.calls.Add(1)
+	select {
+	case <-b.release:
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     b.header.Clone(),
+		Body:       io.NopCloser(bytes.NewReader([]byte("fresh"))),
+	}, nil
+}
+
+func newStaleWhileRevalidateTransport(t *testing.T, age time.Duration) (*Transport, *blockingRoundTripper, *mockClock) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	stored := http.Response{Header: make(http.Header), StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader([]byte("stale")))}
+	stored.Header.Set("Cache-Control", "max-age=60, stale-while-revalidate=60")
+	stored.Header.Set("Date", clock.Now().Add(-age).Format(http.TimeFormat))
+	responseBytes, err := httputil.DumpResponse(&stored, true)
+	assert.NoError(t, err)
+
+	cache := NewCache()
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	cache.Set(buildCacheKey(r).String(), responseBytes)
+
+	origin := &blockingRoundTripper{release: make(chan struct{}), header: make(http.Header)}
+	origin.header.Set("Cache-Control", "max-age=60, stale-while-revalidate=60")
+	origin.header.Set("Date", clock.Now().Format(http.TimeFormat))
+	return NewTransport(cache, origin, WithClock(clock)), origin, clock
+}
+
+func TestRoundTripStaleWhileRevalidate(t *testing.T) {
+	transport, origin, _ := newStaleWhileRevalidateTransport(t, 90*time.Second)
+
+	// the stale response is served without waiting for the origin, and a single revalidation runs
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+		assert.NoError(t, err)
+		response, err := transport.RoundTrip(r)
+		cancel()
+		assert.NoError(t, err)
+		assert.True(t, servedFromCache(response))
+		assert.Equal(t, `110 - "Response is Stale"`, response.Header.Get("Warning"))
+		body, err := io.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "stale", string(body))
+	}
+
+	// the revalidation outlives the canceled caller contexts
+	close(origin.release)
+	assert.Eventually(t, func() bool {
+		transport.mu.Lock()
+		defer transport.mu.Unlock()
+		return len(transport.revalidating) == 0
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), origin.calls.Load())
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Empty(t, response.Header.Get("Warning"))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "fresh", string(body))
+	assert.NoError(t, transport.Close())
+}
+
+func TestRoundTripStaleWhileRevalidateWindowExceeded(t *testing.T) {
+	transport, origin, _ := newStaleWhileRevalidateTransport(t, 150*time.Second)
+	close(origin.release)
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.False(t, servedFromCache(response))
+	assert.Equal(t, int32(1), origin.calls.Load())
+	assert.NoError(t, transport.Close())
+}
+
+func TestTransportCloseStopsRevalidation(t *testing.T) {
+	transport, origin, _ := newStaleWhileRevalidateTransport(t, 90*time.Second)
+
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Eventually(t, func() bool { return origin.calls.Load() == 1 }, time.Second, time.Millisecond)
+
+	// the origin never answers, closing cancels the revalidation
+	assert.NoError(t, transport.Close())
+	assert.Empty(t, transport.revalidating)
+
+	// once closed, stale responses are validated before they are served
+	close(origin.release)
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.False(t, servedFromCache(response))
+	assert.Equal(t, int32(2), origin.calls.Load())
+}
+
+func newStaleIfErrorTransport(t *testing.T, directives string, origin http.RoundTripper, opts ...TransportOption) (*Transport, *mockClock) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	stored := http.Response{Header: make(http.Header), StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader([]byte("stale")))}
+	stored.Header.Set("Cache-Control", directives)
+	stored.Header.Set("Date", clock.Now().Add(-90*time.Second).Format(http.TimeFormat))
+	responseBytes, err := httputil.DumpResponse(&stored, true)
+	assert.NoError(t, err)
+
+	cache := NewCache()
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	cache.Set(buildCacheKey(r).String(), responseBytes)
+	return NewTransport(cache, origin, append(opts, WithClock(clock))...), clock
+}
+
+func TestRoundTripStaleIfError(t *testing.T) {
+	unreachable := &mockRoundTripper{err: errors.New("connection refused")}
+	unavailable := &mockRoundTripper{statusCode: http.StatusServiceUnavailable, body: io.NopCloser(bytes.NewReader(nil))}
+
+	tests := []struct {
+		name              string
+		directives        string
+		requestDirectives string
+		origin            http.RoundTripper
+		opts              []TransportOption
+		servesStale       bool
+	}{
+		{name: "network error", directives: "max-age=60, stale-if-error=60", origin: unreachable, servesStale: true},
+		{name: "server error", directives: "max-age=60, stale-if-error=60", origin: unavailable, servesStale: true},
+		{name: "request directive", directives: "max-age=60", requestDirectives: "stale-if-error=60", origin: unavailable, servesStale: true},
+		{name: "default window", directives: "max-age=60", origin: unreachable, opts: []TransportOption{WithStaleIfError(time.Minute)}, servesStale: true},
+		{name: "window exceeded", directives: "max-age=60, stale-if-error=10", origin: unreachable},
+		{name: "must-revalidate", directives: "max-age=60, stale-if-error=60, must-revalidate", origin: unreachable},
+		{name: "proxy-revalidate", directives: "max-age=60, stale-if-error=60, proxy-revalidate", origin: unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, _ := newStaleIfErrorTransport(t, tt.directives, tt.origin, tt.opts...)
+			r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			assert.NoError(t, err)
+			r.Header.Set("Cache-Control", tt.requestDirectives)
+
+			response, err := transport.RoundTrip(r)
+			if !tt.servesStale {
+				if err == nil {
+					assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Equal(t, fwdStale, cacheStatusParams(response)["fwd"])
+			assert.Equal(t, []string{`110 - "Response is Stale"`, `111 - "Revalidation Failed"`}, response.Header.Values("Warning"))
+			body, err := io.ReadAll(response.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, "stale", string(body))
+		})
+	}
+}
+
+func TestRoundTripNotModifiedFreshensStoredResponse(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	stored := http.Response{Header: make(http.Header), StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader([]byte("hello")))}
+	stored.Header.Set("Cache-Control", "max-age=60")
+	stored.Header.Set("Date", clock.Now().Add(-2*time.Minute).Format(http.TimeFormat))
+	stored.Header.Set("ETag", `"a"`)
+	responseBytes, err := httputil.DumpResponse(&stored, true)
+	assert.NoError(t, err)
+
+	cache := NewCache()
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	cache.Set(buildCacheKey(r).String(), responseBytes)
+
+	notModifiedHeaders := make(http.Header)
+	notModifiedHeaders.Set("Cache-Control", "max-age=120")
+	notModifiedHeaders.Set("Date", clock.Now().Format(http.TimeFormat))
+	origin := &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusNotModified,
+			Header:     notModifiedHeaders,
+			Body:       io.NopCloser(bytes.NewReader([]byte(""))),
+		},
+	}
+	transport := NewTransport(cache, origin, WithClock(clock))
+
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, "max-age=120", response.Header.Get("Cache-Control"))
+	assert.Equal(t, 1, origin.calls)
+
+	// the freshened response is served without contacting the origin again
+	clock.Advance(90 * time.Second)
+	r, err = http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, "90", response.Header.Get("Age"))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, 1, origin.calls)
+}
+
+func TestRoundTripQualifiedNoCacheAndPrivate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []TransportOption
+		removed []string
+		kept    []string
+	}{
+		{name: "private cache", opts: []TransportOption{CachePrivateResponse(true)}, removed: []string{"Set-Cookie"}, kept: []string{"X-User", "Content-Type"}},
+		{name: "default", removed: []string{"Set-Cookie", "X-User"}, kept: []string{"Content-Type"}},
+		{name: "shared cache", opts: []TransportOption{SharedCache(true), CachePrivateResponse(true)}, removed: []string{"Set-Cookie", "X-User"}, kept: []string{"Content-Type"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			header.Set("Cache-Control", `max-age=60, no-cache="Set-Cookie", private="X-User"`)
+			header.Set("Date", time.Now().Format(http.TimeFormat))
+			header.Set("Set-Cookie", "session=1")
+			header.Set("X-User", "alice")
+			header.Set("Content-Type", "text/plain")
+			origin := &mockRoundTripper{
+				response: &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     header,
+					Body:       io.NopCloser(bytes.NewReader([]byte("hello"))),
+				},
+			}
+			transport := NewTransport(NewCache(), origin, tt.opts...)
+
+			r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			assert.NoError(t, err)
+			response, err := roundTripAndRead(t, transport, r)
+			assert.NoError(t, err)
+			assert.Equal(t, "session=1", response.Header.Get("Set-Cookie"))
+			assert.Equal(t, "alice", response.Header.Get("X-User"))
+
+			// the stored response is reused without validation, without the restricted fields
+			response, err = transport.RoundTrip(r)
+			assert.NoError(t, err)
+			assert.True(t, servedFromCache(response))
+			assert.Equal(t, 1, origin.calls)
+			for _, name := range tt.removed {
+				assert.Empty(t, response.Header.Get(name), name)
+			}
+			for _, name := range tt.kept {
+				assert.NotEmpty(t, response.Header.Get(name), name)
+			}
+			body, err := io.ReadAll(response.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(body))
+		})
+	}
+}
+
+// roundTripAndRead sends the request through the transport and reads the response body, as a client does,
+// which stores the response. The response is returned with a copy of the body.
+func roundTripAndRead(t *testing.T, transport http.RoundTripper, r *http.Request) (*http.Response, error) {
+	response, err := transport.RoundTrip(r)
+	if err != nil {
+		return response, err
+	}
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	return response, nil
+}
+
+func TestRoundTripStoresResponseOnceClientReadsBody(t *testing.T) {
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	origin := statusDateOrigin{clock: clock, next: &invalidationOrigin{}}
+	transport := NewTransport(NewCache(), origin, WithClock(clock))
+	r, err := http.NewRequest(http.MethodGet, "http://example.com/items", nil)
+	assert.NoError(t, err)
+
+	// the client abandons the body, the response is not stored
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.NoError(t, response.Body.Close())
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.False(t, servedFromCache(response))
+
+	_, err = io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+}
+
+func TestTransportWithStreamingCache(t *testing.T) {
+	disk, err := NewDiskCache(t.TempDir())
+	assert.NoError(t, err)
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	origin := statusDateOrigin{clock: clock, next: &invalidationOrigin{}}
+	transport := NewTransport(disk, origin, WithClock(clock))
+	r, err := http.NewRequest(http.MethodGet, "http://example.com/items", nil)
+	assert.NoError(t, err)
+
+	response, err := roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	assert.False(t, servedFromCache(response))
+
+	response, err = transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "/items", string(body))
+	assert.NoError(t, response.Body.Close())
+}
+
+// trackingDiskCache counts the bodies read from the disk cache that are not closed yet.
+type trackingDiskCache struct {
+	*diskCache
+	open atomic.Int32
+}
+
+func (c *trackingDiskCache) GetStream(key string) ([]byte, io.ReadCloser, bool) {
+	metadata, body, ok := c.diskCache.GetStream(key)
+	if ok {
+		c.open.Add(1)
+		body = &trackedBody{ReadCloser: body, open: &c.open}
+	}
+	return metadata, body, ok
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	open *atomic.Int32
+	once sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() { b.open.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+func TestTransportWithStreamingCacheRevalidation(t *testing.T) {
+	disk, err := NewDiskCache(t.TempDir())
+	assert.NoError(t, err)
+	cache := &trackingDiskCache{diskCache: disk.(*diskCache)}
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	origin := &mockRoundTripper{}
+	transport := NewTransport(cache, origin, WithClock(clock))
+	r, err := http.NewRequest(http.MethodGet, "http://example.com/items", nil)
+	assert.NoError(t, err)
+	originResponse := func(statusCode int, etag, body string) *http.Response {
+		header := make(http.Header)
+		header.Set("Cache-Control", "max-age=60")
+		header.Set("Date", clock.Now().Format(http.TimeFormat))
+		header.Set("ETag", etag)
+		return &http.Response{StatusCode: statusCode, Header: header, Body: io.NopCloser(bytes.NewReader([]byte(body)))}
+	}
+
+	origin.response = originResponse(http.StatusOK, `"a"`, "hello world")
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	stored, ok := cache.streamBody(buildCacheKey(r).String())
+	assert.True(t, ok)
+
+	// the 304 response freshens the stored response, its body file is kept
+	clock.Advance(2 * time.Minute)
+	origin.response = originResponse(http.StatusNotModified, `"a"`, "")
+	response, err := transport.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, "webcache; fwd=stale; fwd-status=304; ttl=60; stored", response.Header.Get("Cache-Status"))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.NoError(t, response.Body.Close())
+	freshened, ok := cache.streamBody(buildCacheKey(r).String())
 	assert.True(t, ok)
+	assert.Equal(t, stored, freshened)
 
 	response, err = transport.RoundTrip(r)
 	assert.NoError(t, err)
-	assert.True(t, isCached(response))
+	assert.True(t, servedFromCache(response))
+	assert.NoError(t, response.Body.Close())
+	assert.Equal(t, 2, origin.calls)
+
+	// the stale response is replaced, and closed without being served
+	clock.Advance(2 * time.Minute)
+	origin.response = originResponse(http.StatusOK, `"b"`, "hello again")
+	response, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	assert.False(t, servedFromCache(response))
+	body, err = io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello again", string(body))
+	assert.Equal(t, int32(0), cache.open.Load())
+}
+
+func TestTransportWithStreamingCacheServesChunkedResponse(t *testing.T) {
+	disk, err := NewDiskCache(t.TempDir())
+	assert.NoError(t, err)
+	clock := &mockClock{now: time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)}
+	header := make(http.Header)
+	header.Set("Cache-Control", "max-age=60")
+	header.Set("Date", clock.Now().Format(http.TimeFormat))
+	transport := NewTransport(disk, &mockRoundTripper{
+		response: &http.Response{
+			StatusCode:       http.StatusOK,
+			Header:           header,
+			ContentLength:    -1,
+			TransferEncoding: []string{"chunked"},
+			Body:             io.NopCloser(bytes.NewReader([]byte("hello world"))),
+		},
+	}, WithClock(clock))
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.NoError(t, err)
+	_, err = roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+
+	// the length of the stored body is known
+	r.Header.Set("Range", "bytes=0-3")
+	response, err := roundTripAndRead(t, transport, r)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "bytes 0-3/11", response.Header.Get("Content-Range"))
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hell", string(body))
+
+	head, err := http.NewRequest(http.MethodHead, "http://example.com", nil)
+	assert.NoError(t, err)
+	response, err = transport.RoundTrip(head)
+	assert.NoError(t, err)
+	assert.True(t, servedFromCache(response))
+	assert.Equal(t, "11", response.Header.Get("Content-Length"))
+	assert.Equal(t, int64(11), response.ContentLength)
 }
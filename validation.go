@@ -3,6 +3,7 @@ package webcache
 import (
 	"io"
 	"net/http"
+	"strings"
 )
 
 // https://developer.mozilla.org/en-US/docs/Web/HTTP/Caching#validation
@@ -12,88 +13,136 @@ type ResponseValidator interface {
 	Validate(cachedResponse *http.Response, r *http.Request) (*http.Response, error)
 }
 
-type responseValidatorLastModified struct {
-	rt   http.RoundTripper
-	next ResponseValidator
+// conditionalValidator validates a stored response with a single conditional request, that carries
+// every validator of the stored response. The request of the caller is left untouched.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.3.1
+type conditionalValidator struct {
+	rt http.RoundTripper
+	// cache holds the other responses stored for the target URI of the request,
+	// their entity tags are sent along so that the origin can select one of them.
+	cache HTTPCache
 }
 
-func newIfLastModifiedResponseValidator(rt http.RoundTripper, next ResponseValidator) ResponseValidator {
-	return &responseValidatorLastModified{rt: rt, next: next}
+func newResponseValidator(rt http.RoundTripper) *conditionalValidator {
+	return newConditionalValidator(rt, nil)
 }
 
-func (v *responseValidatorLastModified) Validate(cachedResponse *http.Response, r *http.Request) (*http.Response, error) {
-	// if there is no last modified header, then we can't validate
-	lastModified, err := lastModifiedFromHeader(cachedResponse.Header)
-	if err != nil {
-		return v.next.Validate(cachedResponse, r)
-	}
-
-	r.Header = withIFModifiedSinceHeader(r.Header, lastModified)
-
-	response, err := v.rt.RoundTrip(r)
-	if err != nil {
-		return response, err
-	}
-
-	if response.StatusCode == http.StatusNotModified {
-		_, _ = io.Copy(io.Discard, response.Body)
-		response.Body.Close()
-		cachedResponse.Header = withCacheHitHeader(cachedResponse.Header)
-		return cachedResponse, nil
-	}
-
-	return response, nil
+func newConditionalValidator(rt http.RoundTripper, cache HTTPCache) *conditionalValidator {
+	return &conditionalValidator{rt: rt, cache: cache}
 }
 
-type responseValidatorEtag struct {
-	rt   http.RoundTripper
-	next ResponseValidator
+func (v *conditionalValidator) Validate(cachedResponse *http.Response, r *http.Request) (*http.Response, error) {
+	response, _, err := v.validate(cachedResponse, r)
+	return response, err
 }
 
-func newEtagResponseValidator(rt http.RoundTripper, next ResponseValidator) ResponseValidator {
-	return &responseValidatorEtag{rt: rt, next: next}
-}
+// validate returns the response of the origin to the conditional request, or the stored response it selects
+// when it is a 304 response, freshened with its header fields. It reports true in the latter case.
+func (v *conditionalValidator) validate(cachedResponse *http.Response, r *http.Request) (*http.Response, bool, error) {
+	// the validators of a response that does not vary are those of the cached response,
+	// the other responses stored for the URI are only listed when it varies
+	var variants []cacheVariant
+	if l, ok := v.cache.(variantLister); ok && cachedResponse.Header.Get("Vary") != "" {
+		variants = l.variants(r)
+	}
 
-func (v *responseValidatorEtag) Validate(cachedResponse *http.Response, r *http.Request) (*http.Response, error) {
-	etag, err := etagFromHeader(cachedResponse.Header)
-	if err != nil {
-		return v.next.Validate(cachedResponse, r)
+	conditional, ok := conditionalRequest(r, cachedResponse, variants)
+	if !ok {
+		// without validators, the stored response can only be replaced
+		response, err := v.rt.RoundTrip(r)
+		return response, false, err
 	}
 
-	r.Header = withIfNoneMatchHeader(r.Header, etag)
-	response, err := v.rt.RoundTrip(r)
+	response, err := v.rt.RoundTrip(conditional)
 	if err != nil {
-		return response, err
+		return response, false, err
+	}
+	if response.StatusCode != http.StatusNotModified {
+		return response, false, nil
 	}
 
-	if response.StatusCode == http.StatusNotModified {
+	// the 304 response identifies the stored response it freshens by its entity tag
+	// https://www.rfc-editor.org/rfc/rfc9111#section-4.3.4
+	selected := cachedResponse
+	if etag, err := etagFromHeader(response.Header); err == nil {
+		if stored, err := etagFromHeader(cachedResponse.Header); err != nil || stored != etag {
+			selected = v.storedVariant(r, variants, etag)
+			if selected != nil {
+				cachedResponse.Body.Close()
+			}
+		}
+	}
+	if selected == nil {
+		// none of the stored responses match, the full response is needed
 		_, _ = io.Copy(io.Discard, response.Body)
 		response.Body.Close()
-		cachedResponse.Header = withCacheHitHeader(cachedResponse.Header)
-		return cachedResponse, nil
+		response, err := v.rt.RoundTrip(r)
+		return response, false, err
 	}
-
-	return response, nil
+	return notModified(selected, response), true, nil
 }
 
-func newResponseValidator(transport http.RoundTripper) ResponseValidator {
-	return newEtagResponseValidator(
-		transport,
-		newIfLastModifiedResponseValidator(
-			transport,
-			newRevalidator(transport),
-		),
-	)
+// storedVariant returns the stored response with the entity tag, among the variants.
+func (v *conditionalValidator) storedVariant(r *http.Request, variants []cacheVariant, etag string) *http.Response {
+	for _, variant := range variants {
+		if strings.TrimSpace(variant.ETag) != etag {
+			continue
+		}
+		stored, ok := v.cache.Get(variant.request(r))
+		if !ok {
+			return nil
+		}
+		// the variant was replaced since it was listed
+		if current, err := etagFromHeader(stored.Header); err != nil || current != etag {
+			stored.Body.Close()
+			return nil
+		}
+		return stored
+	}
+	return nil
 }
 
-type revalidator struct {
-	transport http.RoundTripper
-}
+// conditionalRequest returns a copy of the request with If-None-Match listing the entity tags of the stored
+// responses, and If-Modified-Since set to the Last-Modified date of the cached response.
+// It returns false when the stored responses have no validator.
+// https://www.rfc-editor.org/rfc/rfc9110#section-13.1
+func conditionalRequest(r *http.Request, cachedResponse *http.Response, variants []cacheVariant) (*http.Request, bool) {
+	seen := make(map[string]bool)
+	var etags []string
+	add := func(etag string) {
+		etag = strings.TrimSpace(etag)
+		if etag != "" && !seen[etag] {
+			seen[etag] = true
+			etags = append(etags, etag)
+		}
+	}
+	add(cachedResponse.Header.Get("ETag"))
+	for _, variant := range variants {
+		add(variant.ETag)
+	}
+	lastModified, lastModifiedErr := lastModifiedFromHeader(cachedResponse.Header)
+	if len(etags) == 0 && lastModifiedErr != nil {
+		return nil, false
+	}
 
-func newRevalidator(transport http.RoundTripper) ResponseValidator {
-	return &revalidator{transport: transport}
+	conditional := r.Clone(r.Context())
+	// the conditions of the client do not apply to the stored responses
+	conditional.Header.Del("If-None-Match")
+	conditional.Header.Del("If-Modified-Since")
+	if len(etags) > 0 {
+		conditional.Header = withIfNoneMatchHeader(conditional.Header, strings.Join(etags, ", "))
+	}
+	if lastModifiedErr == nil {
+		conditional.Header = withIFModifiedSinceHeader(conditional.Header, lastModified)
+	}
+	return conditional, true
 }
 
-func (v *revalidator) Validate(cachedResponse *http.Response, r *http.Request) (*http.Response, error) {
-	return v.transport.RoundTrip(r)
+// notModified freshens the cached response with the header fields of the 304 response of the origin.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.3.4
+func notModified(cachedResponse, response *http.Response) *http.Response {
+	_, _ = io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	cachedResponse.Header = withUpdatedHeaders(cachedResponse.Header, response.Header)
+	return cachedResponse
 }
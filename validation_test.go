@@ -28,9 +28,9 @@ func TestResponseValidationShouldNotCacheIfNoHeadersPresent(t *testing.T) {
 	r, err := http.NewRequest("GET", "http://example.com", nil)
 	assert.NoError(t, err)
 
-	response, err := validator.Validate(&cachedResponse, r)
+	_, freshened, err := validator.validate(&cachedResponse, r)
 	assert.NoError(t, err)
-	assert.Equal(t, "", response.Header.Get("X-Cache"))
+	assert.False(t, freshened)
 }
 
 func TestResponseValidationShouldCacheIfNoEtagButLastModified(t *testing.T) {
@@ -55,9 +55,9 @@ func TestResponseValidationShouldCacheIfNoEtagButLastModified(t *testing.T) {
 	r, err := http.NewRequest("GET", "http://example.com", nil)
 	assert.NoError(t, err)
 
-	response, err := validator.Validate(&cachedResponse, r)
+	_, freshened, err := validator.validate(&cachedResponse, r)
 	assert.NoError(t, err)
-	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.True(t, freshened)
 }
 
 func TestResponseValidationShouldCacheIfNoLastModifiedButEtag(t *testing.T) {
@@ -79,18 +79,26 @@ func TestResponseValidationShouldCacheIfNoLastModifiedButEtag(t *testing.T) {
 	r, err := http.NewRequest("GET", "http://example.com", nil)
 	assert.NoError(t, err)
 
-	response, err := validator.Validate(&cachedResponse, r)
+	_, freshened, err := validator.validate(&cachedResponse, r)
 	assert.NoError(t, err)
-	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.True(t, freshened)
 }
 
-func TestShouldReturnOriginalResposneIfNoETagHeader(t *testing.T) {
+func TestConditionalValidatorSendsEveryValidator(t *testing.T) {
+	lastModified := time.Now().Format(http.TimeFormat)
 	roundTripper := &mockRoundTripper{
-		statusCode: http.StatusNotModified,
-		body:       io.NopCloser(bytes.NewReader([]byte(""))),
+		statusCode:           http.StatusNotModified,
+		body:                 io.NopCloser(bytes.NewReader([]byte(""))),
+		testingT:             t,
+		assertIfNoneMatch:    true,
+		ifNoneMatchValue:     `"a"`,
+		assertLastModified:   true,
+		ifModifiedSinceValue: lastModified,
 	}
-	validator := newEtagResponseValidator(roundTripper, newRevalidator(roundTripper))
+	validator := newResponseValidator(roundTripper)
 	responseHeaders := make(http.Header)
+	responseHeaders.Add("ETag", `"a"`)
+	responseHeaders.Add("Last-Modified", lastModified)
 	cachedResponse := http.Response{
 		Header: responseHeaders,
 		Body:   io.NopCloser(nil),
@@ -99,22 +107,23 @@ func TestShouldReturnOriginalResposneIfNoETagHeader(t *testing.T) {
 	r, err := http.NewRequest("GET", "http://example.com", nil)
 	assert.NoError(t, err)
 
-	response, err := validator.Validate(&cachedResponse, r)
+	_, freshened, err := validator.validate(&cachedResponse, r)
 	assert.NoError(t, err)
-	assert.Equal(t, "", response.Header.Get("X-Cache"))
+	assert.True(t, freshened)
+	assert.Equal(t, 1, roundTripper.calls)
 }
 
-func TestShouldReturnCachedResponseIfEtagRoundTripperReturns304OnValidation(t *testing.T) {
-	// the actual request should return a status 304 - Not Modified
+func TestConditionalValidatorLeavesRequestUntouched(t *testing.T) {
 	roundTripper := &mockRoundTripper{
-		statusCode: http.StatusNotModified,
-		body:       io.NopCloser(bytes.NewReader([]byte(""))),
+		statusCode:        http.StatusNotModified,
+		body:              io.NopCloser(bytes.NewReader([]byte(""))),
+		testingT:          t,
+		assertIfNoneMatch: true,
+		ifNoneMatchValue:  `"a"`,
 	}
-	validator := newEtagResponseValidator(roundTripper, newRevalidator(roundTripper))
-
-	// the response in the cache can have a last modified header
+	validator := newResponseValidator(roundTripper)
 	responseHeaders := make(http.Header)
-	responseHeaders.Add("ETag", "123456789")
+	responseHeaders.Add("ETag", `"a"`)
 	cachedResponse := http.Response{
 		Header: responseHeaders,
 		Body:   io.NopCloser(nil),
@@ -122,19 +131,22 @@ func TestShouldReturnCachedResponseIfEtagRoundTripperReturns304OnValidation(t *t
 
 	r, err := http.NewRequest("GET", "http://example.com", nil)
 	assert.NoError(t, err)
+	r.Header.Set("If-None-Match", `"client"`)
 
-	response, err := validator.Validate(&cachedResponse, r)
+	_, err = validator.Validate(&cachedResponse, r)
 	assert.NoError(t, err)
-	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.Equal(t, `"client"`, r.Header.Get("If-None-Match"))
+	assert.Empty(t, r.Header.Get("If-Modified-Since"))
 }
 
-func TestShouldReturnOriginalResposneIfNoLastModifiedHeader(t *testing.T) {
+func TestConditionalValidatorReturnsChangedResponse(t *testing.T) {
 	roundTripper := &mockRoundTripper{
-		statusCode: http.StatusNotModified,
-		body:       io.NopCloser(bytes.NewReader([]byte(""))),
+		statusCode: http.StatusOK,
+		body:       io.NopCloser(bytes.NewReader([]byte("changed"))),
 	}
-	validator := newIfLastModifiedResponseValidator(roundTripper, newRevalidator(roundTripper))
+	validator := newResponseValidator(roundTripper)
 	responseHeaders := make(http.Header)
+	responseHeaders.Add("ETag", `"a"`)
 	cachedResponse := http.Response{
 		Header: responseHeaders,
 		Body:   io.NopCloser(nil),
@@ -143,32 +155,81 @@ func TestShouldReturnOriginalResposneIfNoLastModifiedHeader(t *testing.T) {
 	r, err := http.NewRequest("GET", "http://example.com", nil)
 	assert.NoError(t, err)
 
-	response, err := validator.Validate(&cachedResponse, r)
+	response, freshened, err := validator.validate(&cachedResponse, r)
 	assert.NoError(t, err)
-	assert.Equal(t, "", response.Header.Get("X-Cache"))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.False(t, freshened)
 }
-func TestShouldReturnCachedResponseIfRoundTripperReturns304OnValidation(t *testing.T) {
-	// the actual request should return a status 304 - Not Modified
+
+func TestConditionalValidatorSelectsOtherVariant(t *testing.T) {
+	notModifiedHeaders := make(http.Header)
+	notModifiedHeaders.Set("ETag", `"b"`)
 	roundTripper := &mockRoundTripper{
-		statusCode: http.StatusNotModified,
-		body:       io.NopCloser(bytes.NewReader([]byte(""))),
+		testingT:          t,
+		assertIfNoneMatch: true,
+		ifNoneMatchValue:  `"a", "b"`,
+		response: &http.Response{
+			StatusCode: http.StatusNotModified,
+			Header:     notModifiedHeaders,
+			Body:       io.NopCloser(bytes.NewReader([]byte(""))),
+		},
 	}
-	validator := newIfLastModifiedResponseValidator(roundTripper, newRevalidator(roundTripper))
 
-	// the response in the cache can have a last modified header
-	responseHeaders := make(http.Header)
-	responseHeaders.Add("Last-Modified", time.Now().Format(http.TimeFormat))
-	cachedResponse := http.Response{
-		Header: responseHeaders,
-		Body:   io.NopCloser(nil),
+	cache := NewHTTPCache(NewCache())
+	storedResponse := func(etag, language, body string) *http.Response {
+		response := newVaryResponse("Accept-Language", body)
+		response.Header.Set("ETag", etag)
+		storeAndRead(t, cache, newVaryRequest(t, language), response)
+		stored, ok := cache.Get(newVaryRequest(t, language))
+		assert.True(t, ok)
+		return stored
 	}
+	cachedResponse := storedResponse(`"a"`, "en-US", "a")
+	storedResponse(`"b"`, "fr", "b")
+	validator := newConditionalValidator(roundTripper, cache)
 
-	r, err := http.NewRequest("GET", "http://example.com", nil)
+	r := newVaryRequest(t, "en-US")
+	response, freshened, err := validator.validate(cachedResponse, r)
+	assert.NoError(t, err)
+	assert.True(t, freshened)
+	body, err := io.ReadAll(response.Body)
 	assert.NoError(t, err)
+	assert.Equal(t, "b", string(body))
+}
+
+// countingCache counts the reads of the cache.
+type countingCache struct {
+	Cache[string, []byte]
+	gets int
+}
+
+func (c *countingCache) Get(key string) ([]byte, bool) {
+	c.gets++
+	return c.Cache.Get(key)
+}
 
-	response, err := validator.Validate(&cachedResponse, r)
+func TestConditionalValidatorDoesNotReadResponseThatDoesNotVary(t *testing.T) {
+	roundTripper := &mockRoundTripper{
+		statusCode:        http.StatusNotModified,
+		body:              io.NopCloser(bytes.NewReader([]byte(""))),
+		testingT:          t,
+		assertIfNoneMatch: true,
+		ifNoneMatchValue:  `"a"`,
+	}
+	backend := &countingCache{Cache: NewCache()}
+	cache := NewHTTPCache(backend)
+	r := newVaryRequest(t, "en-US")
+	response := newVaryResponse("", "hello")
+	response.Header.Set("ETag", `"a"`)
+	storeAndRead(t, cache, r, response)
+	cachedResponse, ok := cache.Get(r)
+	assert.True(t, ok)
+
+	backend.gets = 0
+	_, freshened, err := newConditionalValidator(roundTripper, cache).validate(cachedResponse, r)
 	assert.NoError(t, err)
-	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.True(t, freshened)
+	assert.Equal(t, 0, backend.gets)
 }
 
 type mockRoundTripper struct {
@@ -183,9 +244,16 @@ type mockRoundTripper struct {
 	ifNoneMatchValue  string
 
 	response *http.Response
+	err      error
+
+	calls int
 }
 
 func (m *mockRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	m.calls++
+	if m.err != nil {
+		return nil, m.err
+	}
 
 	if m.assertLastModified {
 		assert.Equal(m.testingT, m.ifModifiedSinceValue, r.Header.Get("If-Modified-Since"))
@@ -201,3 +269,38 @@ func (m *mockRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
 		Body:       m.body,
 	}, nil
 }
+
+func TestResponseValidationMergesNotModifiedHeaders(t *testing.T) {
+	notModifiedHeaders := make(http.Header)
+	notModifiedHeaders.Set("Cache-Control", "max-age=120")
+	notModifiedHeaders.Set("ETag", "123")
+	notModifiedHeaders.Set("Expires", "Sun, 01 Oct 2023 12:02:00 GMT")
+	roundTripper := &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusNotModified,
+			Header:     notModifiedHeaders,
+			Body:       io.NopCloser(bytes.NewReader([]byte(""))),
+		},
+	}
+	validator := newResponseValidator(roundTripper)
+	responseHeaders := make(http.Header)
+	responseHeaders.Set("Cache-Control", "max-age=60")
+	responseHeaders.Set("ETag", "123")
+	responseHeaders.Set("Content-Type", "text/plain")
+	responseHeaders.Set("Content-Length", "5")
+	cachedResponse := http.Response{
+		Header: responseHeaders,
+		Body:   io.NopCloser(bytes.NewReader([]byte("hello"))),
+	}
+
+	r, err := http.NewRequest("GET", "http://example.com", nil)
+	assert.NoError(t, err)
+
+	response, freshened, err := validator.validate(&cachedResponse, r)
+	assert.NoError(t, err)
+	assert.True(t, freshened)
+	assert.Equal(t, "max-age=120", response.Header.Get("Cache-Control"))
+	assert.Equal(t, "Sun, 01 Oct 2023 12:02:00 GMT", response.Header.Get("Expires"))
+	assert.Equal(t, "text/plain", response.Header.Get("Content-Type"))
+	assert.Equal(t, "5", response.Header.Get("Content-Length"))
+}
@@ -0,0 +1,183 @@
+package webcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// variantIndexPrefix marks a cache value as a variant index rather than a stored response.
+var variantIndexPrefix = []byte("webcache-variants\n")
+
+// maxVariants bounds the number of variants kept for a single primary key.
+const maxVariants = 32
+
+// cacheVariant describes a stored response selected by the Vary header of the response.
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.1
+type cacheVariant struct {
+	// Key is the cache key of the stored response.
+	Key string `json:"key"`
+	// Vary holds the field names listed in the Vary header of the stored response.
+	Vary []string `json:"vary"`
+	// Values holds the normalized values of those fields in the request that caused the response to be stored.
+	// A field missing from the request is missing from Values.
+	Values map[string]string `json:"values"`
+	// ETag and LastModified are the validators of the stored response, they are sent when it is validated
+	// without reading the stored response.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// request returns a copy of the request with the header fields that select the variant.
+func (v cacheVariant) request(r *http.Request) *http.Request {
+	selecting := r.Clone(r.Context())
+	for _, name := range v.Vary {
+		selecting.Header.Del(name)
+		if value, ok := v.Values[name]; ok {
+			selecting.Header.Set(name, value)
+		}
+	}
+	return selecting
+}
+
+// variantIndex lists the variants stored under a primary key, the most recent first.
+type variantIndex struct {
+	Variants []cacheVariant `json:"variants"`
+}
+
+func newCacheVariant(primary cacheKey, vary []string, h http.Header) cacheVariant {
+	values := make(map[string]string, len(vary))
+	for _, name := range vary {
+		if v, ok := normalizedFieldValue(h, name); ok {
+			values[name] = v
+		}
+	}
+	return cacheVariant{
+		Key:    buildVariantKey(primary, vary, values).String(),
+		Vary:   vary,
+		Values: values,
+	}
+}
+
+// withValidators records the validators of the stored response in the variant.
+func (v cacheVariant) withValidators(h http.Header) cacheVariant {
+	v.ETag = h.Get("ETag")
+	v.LastModified = h.Get("Last-Modified")
+	return v
+}
+
+// matches reports whether the request selects the variant.
+func (v cacheVariant) matches(h http.Header) bool {
+	for _, name := range v.Vary {
+		stored, storedOk := v.Values[name]
+		value, ok := normalizedFieldValue(h, name)
+		if ok != storedOk || value != stored {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the most recent variant selected by the request.
+func (idx variantIndex) match(h http.Header) (cacheVariant, bool) {
+	for _, v := range idx.Variants {
+		if v.matches(h) {
+			return v, true
+		}
+	}
+	return cacheVariant{}, false
+}
+
+// add puts the variant first, replacing a variant with the same key.
+// It returns the variants that no longer fit the index.
+func (idx *variantIndex) add(v cacheVariant) []cacheVariant {
+	variants := []cacheVariant{v}
+	for _, existing := range idx.Variants {
+		if existing.Key != v.Key {
+			variants = append(variants, existing)
+		}
+	}
+
+	var evicted []cacheVariant
+	if len(variants) > maxVariants {
+		evicted = variants[maxVariants:]
+		variants = variants[:maxVariants]
+	}
+	idx.Variants = variants
+	return evicted
+}
+
+func isVariantIndex(b []byte) bool {
+	return bytes.HasPrefix(b, variantIndexPrefix)
+}
+
+func decodeVariantIndex(b []byte) (variantIndex, bool) {
+	var idx variantIndex
+	if !isVariantIndex(b) {
+		return idx, false
+	}
+	if err := json.Unmarshal(b[len(variantIndexPrefix):], &idx); err != nil {
+		return idx, false
+	}
+	return idx, true
+}
+
+func encodeVariantIndex(idx variantIndex) ([]byte, error) {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, variantIndexPrefix...), b...), nil
+}
+
+// varyFieldNames returns the canonical field names listed in the Vary header of a response.
+func varyFieldNames(h http.Header) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name != "*" {
+				name = http.CanonicalHeaderKey(name)
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varyWildcard reports whether the response varies on something outside the request,
+// in which case it can never be selected by a later request.
+func varyWildcard(vary []string) bool {
+	for _, name := range vary {
+		if name == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizedFieldValue combines the field lines of the header and removes the whitespace
+// around each list member, so that semantically equal values compare equal.
+func normalizedFieldValue(h http.Header, name string) (string, bool) {
+	values := h.Values(name)
+	if len(values) == 0 {
+		return "", false
+	}
+	members := make([]string, 0, len(values))
+	for _, v := range values {
+		for _, member := range strings.Split(v, ",") {
+			members = append(members, strings.TrimSpace(member))
+		}
+	}
+	return strings.Join(members, ","), true
+}
@@ -0,0 +1,63 @@
+package webcache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaryFieldNames(t *testing.T) {
+	h := make(http.Header)
+	assert.Empty(t, varyFieldNames(h))
+
+	h.Add("Vary", "accept-language, Accept")
+	h.Add("Vary", "ACCEPT")
+	assert.Equal(t, []string{"Accept", "Accept-Language"}, varyFieldNames(h))
+	assert.False(t, varyWildcard(varyFieldNames(h)))
+
+	h.Set("Vary", "Accept, *")
+	assert.True(t, varyWildcard(varyFieldNames(h)))
+}
+
+func TestCacheVariantMatches(t *testing.T) {
+	h := make(http.Header)
+	h.Add("Accept-Encoding", "gzip,  br")
+	variant := newCacheVariant(cacheKey("cache_key=GET_http://example.com"), []string{"Accept-Encoding", "Accept-Language"}, h)
+
+	other := make(http.Header)
+	other.Add("Accept-Encoding", "gzip")
+	other.Add("Accept-Encoding", "br")
+	assert.True(t, variant.matches(other))
+
+	other.Set("Accept-Language", "en")
+	assert.False(t, variant.matches(other))
+
+	other = make(http.Header)
+	other.Add("Accept-Encoding", "br, gzip")
+	assert.False(t, variant.matches(other))
+}
+
+func TestVariantIndexEncoding(t *testing.T) {
+	idx := variantIndex{}
+	for i := 0; i < maxVariants+2; i++ {
+		h := make(http.Header)
+		h.Set("Accept", string(rune('a'+i)))
+		evicted := idx.add(newCacheVariant(cacheKey("k"), []string{"Accept"}, h))
+		if i < maxVariants {
+			assert.Empty(t, evicted)
+		} else {
+			assert.Len(t, evicted, 1)
+		}
+	}
+	assert.Len(t, idx.Variants, maxVariants)
+
+	b, err := encodeVariantIndex(idx)
+	assert.NoError(t, err)
+	decoded, ok := decodeVariantIndex(b)
+	assert.True(t, ok)
+	assert.Equal(t, idx, decoded)
+
+	_, ok = decodeVariantIndex([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	assert.False(t, ok)
+}